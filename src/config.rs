@@ -1,21 +1,44 @@
+use std::collections::HashMap;
 use std::fs;
 use std::io;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::str::FromStr;
 use std::{env, ffi::OsString};
 
 use anyhow::bail;
 use anyhow::{Context, Result};
-use clap::Parser;
+use clap::parser::ValueSource;
+use clap::{ArgMatches, CommandFactory, FromArgMatches, Parser};
+use log::warn;
+use serde::Deserialize;
 
 use std::net::SocketAddr;
 
-use crate::net::Auth;
+use crate::net::{Auth, Connection};
+use crate::schedule::Schedule;
+use crate::sync::{Backpressure, ConflictPolicy, HashAlgo, NameTemplate, RecvLimit, SyncTypes};
 
 /// Sync clipboard between different machines via network.
 #[derive(Parser, Debug)]
 #[command(author, version, about, long_about = None)]
 pub struct Arg {
+    /// The config file, can be a toml or json file. The options in the command
+    /// line override the ones in the file. If not specified, try to load
+    /// "config.toml" or "config.json" under the "csync" config directory.
+    /// (env: CSYNC_CONFIG_PATH)
+    #[arg(short, long)]
+    pub config: Option<String>,
+
+    /// The profile in the config file to use, its options override the ones
+    /// at the top level of the file. (env: CSYNC_PROFILE)
+    #[arg(long)]
+    pub profile: Option<String>,
+
+    /// Report unknown options in the config file as an error, rather than
+    /// ignoring them with a warning.
+    #[arg(long)]
+    pub strict_config: bool,
+
     /// TCP bind address. (env: CSYNC_CONFIG_BIND)
     #[arg(short, long, default_value = "0.0.0.0:9790")]
     pub bind: String,
@@ -37,11 +60,18 @@ pub struct Arg {
     #[arg(short, long, default_value = "300")]
     pub interval: u64,
 
+    /// Interval (ms) to listen clipboard after it has not changed for one
+    /// minute, zero means always use `interval`. If not zero, must be in the
+    /// range [interval, 10000]. (env: CSYNC_CONFIG_IDLE_INTERVAL)
+    #[arg(long, default_value = "0")]
+    pub idle_interval: u64,
+
     /// The directory to write sync file. (env: CSYNC_CONFIG_DIR)
     #[arg(short, long, default_value = "")]
     pub dir: String,
 
-    /// The file to send.
+    /// The file to send to the targets, csync exits once it is sent. The peers
+    /// write it under their `dir`.
     #[arg(short, long)]
     pub file: Option<String>,
 
@@ -54,6 +84,172 @@ pub struct Arg {
     /// than this time, it will be released. Must be in the range [10, 600].
     #[arg(long, default_value = "120")]
     pub conn_live: u32,
+
+    /// The number of received frames that can be buffered before being written
+    /// to the clipboard. (env: CSYNC_CONFIG_CHANNEL_SIZE)
+    #[arg(long, default_value = "50")]
+    pub channel_size: usize,
+
+    /// What to do with the buffered frames when writing to the clipboard falls
+    /// behind, can be "block", "drop-oldest" or "drop-images-first".
+    /// (env: CSYNC_CONFIG_BACKPRESSURE)
+    #[arg(long, default_value = "block")]
+    pub backpressure: String,
+
+    /// The max bytes per second to send to each target, zero means unlimited.
+    /// (env: CSYNC_CONFIG_MAX_BANDWIDTH)
+    #[arg(long, default_value = "0")]
+    pub max_bandwidth: u64,
+
+    /// The hash algorithm to detect clipboard changes, can be "sha256" or
+    /// "xxh3". xxh3 is much faster for large images. (env: CSYNC_CONFIG_HASH)
+    #[arg(long, default_value = "sha256")]
+    pub hash: String,
+
+    /// Only read the clipboard and send its changes to targets, the data
+    /// received is not written to the clipboard. (env: CSYNC_CONFIG_READ_ONLY)
+    #[arg(long)]
+    pub read_only: bool,
+
+    /// Only write the data received to the clipboard, the clipboard changes
+    /// are not sent to targets. (env: CSYNC_CONFIG_WRITE_ONLY)
+    #[arg(long)]
+    pub write_only: bool,
+
+    /// The data types to sync, split with comma, can be "text", "image" and
+    /// "file". Applied both when sending and receiving.
+    /// (env: CSYNC_CONFIG_TYPES)
+    #[arg(long, default_value = "text,image,file")]
+    pub types: String,
+
+    /// Only sync in this time range of the day, like "09:00-18:00". The range
+    /// can cross midnight, like "22:00-06:00", but the start and end could not
+    /// be the same. Empty means all day.
+    /// (env: CSYNC_CONFIG_ACTIVE_HOURS)
+    #[arg(long, default_value = "")]
+    pub active_hours: String,
+
+    /// Only sync on these days, like "mon-fri" or "mon,wed,fri". Empty means
+    /// every day. (env: CSYNC_CONFIG_ACTIVE_DAYS)
+    #[arg(long, default_value = "")]
+    pub active_days: String,
+
+    /// The max size (bytes) of the data in a received frame, larger frames are
+    /// rejected before being read into memory, default is 256MiB.
+    /// (env: CSYNC_CONFIG_MAX_FRAME_SIZE)
+    #[arg(long, default_value_t = Connection::MAX_FRAME_SIZE)]
+    pub max_frame_size: usize,
+
+    /// Accept unencrypted data from peers even if the password is configured.
+    /// By default such data is rejected. Useful when migrating the peers to a
+    /// password one by one. (env: CSYNC_CONFIG_ALLOW_PLAIN)
+    #[arg(long)]
+    pub allow_plain: bool,
+
+    /// After writing the data received to the clipboard, read it back to
+    /// verify, and retry the write at most this many times if it did not take
+    /// effect. Images are verified by their dimensions only, as the pixels
+    /// may be converted. 0 disables the verification.
+    /// (env: CSYNC_CONFIG_WRITE_RETRY)
+    #[arg(long, default_value = "3")]
+    pub write_retry: u32,
+
+    /// When the text copied is a url, strip the tracking query parameters (like
+    /// "utm_source" and "fbclid") before sending it, the local clipboard is not
+    /// changed. (env: CSYNC_CONFIG_STRIP_URL_TRACKING)
+    #[arg(long)]
+    pub strip_url_tracking: bool,
+
+    /// Show at most this many characters of the clipboard text in logs. By
+    /// default, only the size and the hash of the content are logged.
+    /// (env: CSYNC_CONFIG_LOG_PREVIEW)
+    #[arg(long, default_value = "0")]
+    pub log_preview: usize,
+
+    /// The max size (bytes) of the text received to write to the clipboard,
+    /// larger text is dropped. Zero means unlimited.
+    /// (env: CSYNC_CONFIG_MAX_RECV_TEXT)
+    #[arg(long, default_value = "0")]
+    pub max_recv_text: usize,
+
+    /// The max dimensions of the image received to write to the clipboard,
+    /// like "3840x2160", larger images are dropped. Empty means unlimited.
+    /// To reject the files received, remove "file" from `types`.
+    /// (env: CSYNC_CONFIG_MAX_RECV_IMAGE)
+    #[arg(long, default_value = "")]
+    pub max_recv_image: String,
+
+    /// What to do when the data received conflicts with a local change made
+    /// just before, can be "latest" or "prefer-local". With "latest", the data
+    /// that comes last wins, with "prefer-local", the data received within
+    /// seconds after a local change is dropped. (env: CSYNC_CONFIG_CONFLICT)
+    #[arg(long, default_value = "latest")]
+    pub conflict: String,
+
+    /// Only log what would be sent and received, without connecting to the
+    /// targets or writing the clipboard and files. Useful to check the options
+    /// before enabling the real sync. (env: CSYNC_CONFIG_OBSERVE)
+    #[arg(long)]
+    pub observe: bool,
+
+    /// The timeout (s) to connect to a target, and for each write to it to
+    /// make progress, so that a stuck target does not hold up the sync. Large
+    /// data under a low `max-bandwidth` does not time out as long as it keeps
+    /// moving. Zero means no timeout. (env: CSYNC_CONFIG_TIMEOUT)
+    #[arg(long, default_value = "10")]
+    pub timeout: u64,
+
+    /// The data type to read when the clipboard holds both text and image,
+    /// can be "text" or "image". (env: CSYNC_CONFIG_PREFER)
+    #[arg(long, default_value = "text")]
+    pub prefer: String,
+
+    /// Besides writing to the clipboard, also write the data received to files
+    /// under `dir`, split with comma, can be "text" and "image". The images are
+    /// written as raw RGBA pixels. (env: CSYNC_CONFIG_TEE)
+    #[arg(long, default_value = "")]
+    pub tee: String,
+
+    /// The names of the files written by tee, relative to `dir`. The
+    /// placeholders are "{type}" (text or image), "{date}", "{time}", "{seq}"
+    /// (counted from 1 after start), "{hash}", "{dims}" (like "-1920x1080" for
+    /// images, empty for text) and "{ext}" (txt or rgba). Use "/" to write to
+    /// subdirectories. (env: CSYNC_CONFIG_TEE_NAME)
+    #[arg(long, default_value = "{type}-{time}{dims}.{ext}")]
+    pub tee_name: String,
+
+    /// Time (ms) the clipboard must not be changed locally before the data
+    /// received is written to it, so that the user is not disturbed in the
+    /// middle of a copy. If it is changed again meanwhile, the local data wins
+    /// and the data received is dropped. Zero means writing at once. Must be
+    /// in the range [0, 10000]. (env: CSYNC_CONFIG_WRITE_IDLE)
+    #[arg(long, default_value = "0")]
+    pub write_idle: u64,
+
+    /// The number of entries to keep in the history of the data sent and
+    /// received, stored in "history.jsonl" under `dir`. The history includes
+    /// the text content. Zero disables the history. (env: CSYNC_CONFIG_HISTORY)
+    #[arg(long, default_value = "0")]
+    pub history: usize,
+
+    /// Print the history and exit.
+    #[arg(long)]
+    pub list_history: bool,
+
+    /// Expand the template with this name, defined in the "templates" table
+    /// of the config file, send it to the targets as text and exit. The
+    /// "{{name}}" placeholders in the template are replaced with the `var`
+    /// values, the missing ones are asked on the terminal.
+    #[arg(long)]
+    pub template: Option<String>,
+
+    /// The value of a template placeholder, like "name=value", can be repeated.
+    #[arg(long)]
+    pub var: Vec<String>,
+
+    /// The templates loaded from the config file.
+    #[arg(skip)]
+    pub templates: HashMap<String, String>,
 }
 
 #[derive(Debug, Clone)]
@@ -63,16 +259,454 @@ pub struct Config {
     pub targets: Vec<SocketAddr>,
 
     pub interval: u64,
+    pub idle_interval: u64,
 
     pub dir: PathBuf,
 
     pub conn_max: u32,
     pub conn_live: u32,
 
+    pub channel_size: usize,
+    pub backpressure: Backpressure,
+
+    pub max_bandwidth: u64,
+
+    pub hash_algo: HashAlgo,
+
+    pub read_only: bool,
+    pub write_only: bool,
+
+    pub types: SyncTypes,
+
+    pub schedule: Option<Schedule>,
+
+    pub max_frame_size: usize,
+    pub allow_plain: bool,
+
+    pub write_retry: u32,
+    pub write_idle: u64,
+
+    pub strip_url_tracking: bool,
+
+    pub log_preview: usize,
+
+    pub recv_limit: RecvLimit,
+
+    pub conflict: ConflictPolicy,
+
+    pub observe: bool,
+
+    pub timeout: u64,
+
+    pub prefer_image: bool,
+
+    pub tee: SyncTypes,
+    pub tee_name: NameTemplate,
+
+    pub history: usize,
+
+    pub templates: HashMap<String, String>,
+
     pub auth_key: Option<Vec<u8>>,
 }
 
+/// The content of the config file. Each field has the same meaning as the
+/// command line option with the same name.
+#[derive(Deserialize, Debug, Default)]
+pub struct FileConfig {
+    /// Other config files to load first, the options in this file override
+    /// theirs. Relative paths are relative to this file.
+    #[serde(default)]
+    pub include: Vec<String>,
+
+    pub bind: Option<String>,
+    pub target: Option<String>,
+    pub password: Option<String>,
+    pub interval: Option<u64>,
+    pub idle_interval: Option<u64>,
+    pub dir: Option<String>,
+    pub conn_max: Option<u32>,
+    pub conn_live: Option<u32>,
+    pub channel_size: Option<usize>,
+    pub backpressure: Option<String>,
+    pub max_bandwidth: Option<u64>,
+    pub hash: Option<String>,
+    pub read_only: Option<bool>,
+    pub write_only: Option<bool>,
+    pub types: Option<String>,
+    pub active_hours: Option<String>,
+    pub active_days: Option<String>,
+    pub max_frame_size: Option<usize>,
+    pub allow_plain: Option<bool>,
+    pub write_retry: Option<u32>,
+    pub strip_url_tracking: Option<bool>,
+    pub log_preview: Option<usize>,
+    pub max_recv_text: Option<usize>,
+    pub max_recv_image: Option<String>,
+    pub conflict: Option<String>,
+    pub observe: Option<bool>,
+    pub timeout: Option<u64>,
+    pub prefer: Option<String>,
+    pub tee: Option<String>,
+    pub tee_name: Option<String>,
+    pub write_idle: Option<u64>,
+    pub history: Option<usize>,
+
+    /// Text templates by name, to send with the `template` option. Unlike the
+    /// string options, `${VAR}` in them is not expanded.
+    #[serde(default)]
+    pub templates: HashMap<String, String>,
+
+    /// Named sets of options, to describe different setups in one file, e.g.
+    /// home and office.
+    #[serde(default)]
+    pub profiles: HashMap<String, FileConfig>,
+}
+
+impl FileConfig {
+    const FILE_NAMES: [&str; 2] = ["config.toml", "config.json"];
+
+    /// Load the config file, with its included files merged below it, and its
+    /// local override file (e.g. "config.local.toml" for "config.toml") merged
+    /// on top of it. The local file is meant for machine-specific options that
+    /// should not be shared with other machines.
+    pub fn load(path: &Path, strict: bool) -> Result<FileConfig> {
+        let mut cfg = Self::load_with_include(path, strict, &mut Vec::new())?;
+
+        let local_path = Self::local_path(path);
+        if local_path.is_file() {
+            let local = Self::load_with_include(&local_path, strict, &mut Vec::new())?;
+            cfg.merge(local);
+        }
+
+        Ok(cfg)
+    }
+
+    /// Load the config file and its included files recursively, `stack` is the
+    /// files being loaded, used to detect include cycles. The paths are
+    /// canonicalized, so that "sub/../a.toml" is found to be "a.toml".
+    fn load_with_include(
+        path: &Path,
+        strict: bool,
+        stack: &mut Vec<PathBuf>,
+    ) -> Result<FileConfig> {
+        let path = fs::canonicalize(path)
+            .with_context(|| format!(r#"Read config file "{}""#, path.display()))?;
+        if stack.contains(&path) {
+            bail!(r#"Config file "{}" includes itself"#, path.display());
+        }
+
+        let mut file = Self::read(&path, strict)?;
+        let dir = path.parent().unwrap_or(Path::new(""));
+        let mut cfg = FileConfig::default();
+        for include in file.include.drain(..) {
+            let include_path = dir.join(include);
+            stack.push(path.clone());
+            let include_cfg = Self::load_with_include(&include_path, strict, stack);
+            stack.pop();
+            cfg.merge(include_cfg?);
+        }
+        cfg.merge(file);
+
+        Ok(cfg)
+    }
+
+    fn local_path(path: &Path) -> PathBuf {
+        let stem = path.file_stem().and_then(|s| s.to_str()).unwrap_or("");
+        let name = match path.extension().and_then(|s| s.to_str()) {
+            Some(ext) => format!("{stem}.local.{ext}"),
+            None => format!("{stem}.local"),
+        };
+        path.with_file_name(name)
+    }
+
+    /// Read the config file, the format is detected by its extension.
+    ///
+    /// The errors of invalid values come with their line and column. Unknown
+    /// options are all collected, if `strict` is true, they are reported as
+    /// an error, otherwise they are ignored with a warning.
+    pub fn read(path: &Path, strict: bool) -> Result<FileConfig> {
+        let data = fs::read_to_string(path)
+            .with_context(|| format!(r#"Read config file "{}""#, path.display()))?;
+        let ext = path.extension().and_then(|ext| ext.to_str()).unwrap_or("");
+
+        let mut unknown = Vec::new();
+        let record = |key: serde_ignored::Path| unknown.push(key.to_string());
+        let cfg: FileConfig = match ext {
+            "toml" => serde_ignored::deserialize(toml::Deserializer::new(&data), record)
+                .with_context(|| format!(r#"Parse toml config file "{}""#, path.display()))?,
+            "json" => {
+                let mut de = serde_json::Deserializer::from_str(&data);
+                serde_ignored::deserialize(&mut de, record)
+                    .with_context(|| format!(r#"Parse json config file "{}""#, path.display()))?
+            }
+            _ => bail!(
+                r#"Unsupported config file "{}", the extension should be "toml" or "json""#,
+                path.display()
+            ),
+        };
+
+        if !unknown.is_empty() {
+            if strict {
+                bail!(
+                    r#"Unknown options in config file "{}": {}"#,
+                    path.display(),
+                    unknown.join(", ")
+                );
+            }
+            for key in unknown {
+                warn!(
+                    r#"Unknown option "{key}" in config file "{}", ignored"#,
+                    path.display()
+                );
+            }
+        }
+
+        Ok(cfg)
+    }
+
+    /// Find the config file under the default config directory.
+    fn default_path() -> Option<PathBuf> {
+        let dir = dirs::config_dir()?.join("csync");
+        Self::FILE_NAMES
+            .iter()
+            .map(|name| dir.join(name))
+            .find(|path| path.is_file())
+    }
+
+    /// Override the options with the ones in the profile `name`.
+    pub fn use_profile(&mut self, name: &str) -> Result<()> {
+        let profile = match self.profiles.remove(name) {
+            Some(profile) => profile,
+            None => bail!(r#"Could not find profile "{name}""#),
+        };
+        if !profile.profiles.is_empty() {
+            bail!(r#"Invalid profile "{name}", profiles could not be nested"#);
+        }
+        self.merge(profile);
+        Ok(())
+    }
+
+    /// Override the options with the ones set in `other`.
+    fn merge(&mut self, other: FileConfig) {
+        macro_rules! merge {
+            ($($field:ident),+) => {
+                $(
+                    if other.$field.is_some() {
+                        self.$field = other.$field;
+                    }
+                )+
+            };
+        }
+        merge!(
+            bind,
+            target,
+            password,
+            interval,
+            idle_interval,
+            dir,
+            conn_max,
+            conn_live,
+            channel_size,
+            backpressure,
+            max_bandwidth,
+            hash,
+            read_only,
+            write_only,
+            types,
+            active_hours,
+            active_days,
+            max_frame_size,
+            allow_plain,
+            write_retry,
+            strip_url_tracking,
+            log_preview,
+            max_recv_text,
+            max_recv_image,
+            conflict,
+            observe,
+            timeout,
+            prefer,
+            tee,
+            tee_name,
+            write_idle,
+            history
+        );
+        self.templates.extend(other.templates);
+        for (name, profile) in other.profiles {
+            self.profiles.entry(name).or_default().merge(profile);
+        }
+    }
+
+    /// Expand the `${VAR}` references in the string options with environment
+    /// variables, so that secrets and per-host values do not have to be
+    /// written in the file. Use `$$` to write a literal `$`.
+    pub fn expand_env(&mut self) -> Result<()> {
+        macro_rules! expand {
+            ($($field:ident),+) => {
+                $(
+                    if let Some(value) = $field {
+                        *value = expand_env(value).with_context(|| {
+                            format!("Expand env in config option {}", stringify!($field))
+                        })?;
+                    }
+                )+
+            };
+        }
+        // No `..` here, so that a new option can not be added without
+        // deciding whether it is expanded.
+        let FileConfig {
+            // Resolved when the file is loaded.
+            include: _,
+            bind,
+            target,
+            password,
+            interval: _,
+            idle_interval: _,
+            dir,
+            conn_max: _,
+            conn_live: _,
+            channel_size: _,
+            backpressure,
+            max_bandwidth: _,
+            hash,
+            read_only: _,
+            write_only: _,
+            types,
+            active_hours,
+            active_days,
+            max_frame_size: _,
+            allow_plain: _,
+            write_retry: _,
+            strip_url_tracking: _,
+            log_preview: _,
+            max_recv_text: _,
+            max_recv_image,
+            conflict,
+            observe: _,
+            timeout: _,
+            prefer,
+            tee,
+            tee_name,
+            write_idle: _,
+            history: _,
+            // The templates are sent as they are, they may contain `${VAR}`
+            // meant for a shell.
+            templates: _,
+            // Merged into the options by `use_profile` already.
+            profiles: _,
+        } = self;
+        expand!(
+            bind,
+            target,
+            password,
+            dir,
+            backpressure,
+            hash,
+            types,
+            active_hours,
+            active_days,
+            max_recv_image,
+            conflict,
+            prefer,
+            tee,
+            tee_name
+        );
+        Ok(())
+    }
+
+    /// Write the values in the file to `arg`, except for the ones specified in
+    /// the command line.
+    fn apply(self, arg: &mut Arg, matches: &ArgMatches) {
+        macro_rules! apply {
+            ($($field:ident),+) => {
+                $(
+                    if let Some(value) = self.$field {
+                        let source = matches.value_source(stringify!($field));
+                        if source != Some(ValueSource::CommandLine) {
+                            arg.$field = value;
+                        }
+                    }
+                )+
+            };
+        }
+        apply!(
+            bind,
+            target,
+            interval,
+            idle_interval,
+            dir,
+            conn_max,
+            conn_live,
+            channel_size,
+            backpressure,
+            max_bandwidth,
+            hash,
+            read_only,
+            write_only,
+            types,
+            active_hours,
+            active_days,
+            max_frame_size,
+            allow_plain,
+            write_retry,
+            strip_url_tracking,
+            log_preview,
+            max_recv_text,
+            max_recv_image,
+            conflict,
+            observe,
+            timeout,
+            prefer,
+            tee,
+            tee_name,
+            write_idle,
+            history
+        );
+        if arg.password.is_none() {
+            arg.password = self.password;
+        }
+        arg.templates = self.templates;
+    }
+}
+
 impl Arg {
+    /// Parse the command line arguments, the options not specified are loaded
+    /// from the config file, if there is one.
+    pub fn load() -> Result<Arg> {
+        let matches = Self::command().get_matches();
+        let mut arg = Self::from_arg_matches(&matches).unwrap_or_else(|err| err.exit());
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_PATH") {
+            arg.config = Some(parse_osstr(s)?);
+        }
+        let path = match &arg.config {
+            Some(path) => Some(PathBuf::from(path)),
+            None => FileConfig::default_path(),
+        };
+        if let Some(s) = env::var_os("CSYNC_PROFILE") {
+            arg.profile = Some(parse_osstr(s)?);
+        }
+        match path {
+            Some(path) => {
+                let mut file = FileConfig::load(&path, arg.strict_config)?;
+                if let Some(profile) = &arg.profile {
+                    file.use_profile(profile)
+                        .with_context(|| format!(r#"Use config file "{}""#, path.display()))?;
+                }
+                file.expand_env()?;
+                file.apply(&mut arg, &matches);
+            }
+            None => {
+                if let Some(profile) = &arg.profile {
+                    bail!(r#"Could not use profile "{profile}", no config file found"#);
+                }
+            }
+        }
+
+        Ok(arg)
+    }
+
     pub fn normalize(&mut self) -> Result<Config> {
         if let Some(s) = env::var_os("CSYNC_CONFIG_BIND") {
             self.bind = parse_osstr(s)?;
@@ -123,6 +757,21 @@ impl Arg {
             );
         }
 
+        if let Some(s) = env::var_os("CSYNC_CONFIG_IDLE_INTERVAL") {
+            let interval = parse_osstr(s)?;
+            let interval: u64 = interval.parse().context("Could not parse idle interval")?;
+            self.idle_interval = interval;
+        }
+        if self.idle_interval != 0
+            && (self.idle_interval < self.interval || self.idle_interval > 10000)
+        {
+            bail!(
+                "Invalid idle interval {}, It must be in the range [{},10000]",
+                self.idle_interval,
+                self.interval
+            );
+        }
+
         if let Some(s) = env::var_os("CSYNC_CONFIG_DIR") {
             self.dir = parse_osstr(s)?;
         }
@@ -156,18 +805,235 @@ impl Arg {
             );
         }
 
+        if let Some(s) = env::var_os("CSYNC_CONFIG_CHANNEL_SIZE") {
+            let size = parse_osstr(s)?;
+            self.channel_size = size.parse().context("Could not parse channel size")?;
+        }
+        if self.channel_size == 0 {
+            bail!("Invalid channel-size, could not be zero");
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_BACKPRESSURE") {
+            self.backpressure = parse_osstr(s)?;
+        }
+        let backpressure = Backpressure::parse(&self.backpressure)?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_MAX_BANDWIDTH") {
+            let bandwidth = parse_osstr(s)?;
+            self.max_bandwidth = bandwidth.parse().context("Could not parse max bandwidth")?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_HASH") {
+            self.hash = parse_osstr(s)?;
+        }
+        let hash_algo = HashAlgo::parse(&self.hash)?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_READ_ONLY") {
+            self.read_only = parse_bool(&parse_osstr(s)?)?;
+        }
+        if let Some(s) = env::var_os("CSYNC_CONFIG_WRITE_ONLY") {
+            self.write_only = parse_bool(&parse_osstr(s)?)?;
+        }
+        if self.read_only && self.write_only {
+            bail!("The read-only and write-only could not be enabled at the same time");
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_TYPES") {
+            self.types = parse_osstr(s)?;
+        }
+        let types = SyncTypes::parse(&self.types)?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_ACTIVE_HOURS") {
+            self.active_hours = parse_osstr(s)?;
+        }
+        if let Some(s) = env::var_os("CSYNC_CONFIG_ACTIVE_DAYS") {
+            self.active_days = parse_osstr(s)?;
+        }
+        let schedule = if self.active_hours.is_empty() && self.active_days.is_empty() {
+            None
+        } else {
+            Some(Schedule::parse(&self.active_hours, &self.active_days)?)
+        };
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_MAX_FRAME_SIZE") {
+            let size = parse_osstr(s)?;
+            self.max_frame_size = size.parse().context("Could not parse max frame size")?;
+        }
+        if self.max_frame_size == 0 {
+            bail!("Invalid max-frame-size, could not be zero");
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_ALLOW_PLAIN") {
+            self.allow_plain = parse_bool(&parse_osstr(s)?)?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_WRITE_RETRY") {
+            let retry = parse_osstr(s)?;
+            self.write_retry = retry.parse().context("Could not parse write retry")?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_WRITE_IDLE") {
+            let idle = parse_osstr(s)?;
+            self.write_idle = idle.parse().context("Could not parse write idle")?;
+        }
+        if self.write_idle > 10000 {
+            bail!(
+                "Invalid write idle {}, It must be in the range [0,10000]",
+                self.write_idle
+            );
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_STRIP_URL_TRACKING") {
+            self.strip_url_tracking = parse_bool(&parse_osstr(s)?)?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_LOG_PREVIEW") {
+            let preview = parse_osstr(s)?;
+            self.log_preview = preview.parse().context("Could not parse log preview")?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_MAX_RECV_TEXT") {
+            let size = parse_osstr(s)?;
+            self.max_recv_text = size.parse().context("Could not parse max recv text")?;
+        }
+        if let Some(s) = env::var_os("CSYNC_CONFIG_MAX_RECV_IMAGE") {
+            self.max_recv_image = parse_osstr(s)?;
+        }
+        let recv_limit = RecvLimit::parse(self.max_recv_text, &self.max_recv_image)?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_CONFLICT") {
+            self.conflict = parse_osstr(s)?;
+        }
+        let conflict = ConflictPolicy::parse(&self.conflict)?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_OBSERVE") {
+            self.observe = parse_bool(&parse_osstr(s)?)?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_TIMEOUT") {
+            let timeout = parse_osstr(s)?;
+            self.timeout = timeout.parse().context("Could not parse timeout")?;
+        }
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_PREFER") {
+            self.prefer = parse_osstr(s)?;
+        }
+        let prefer_image = match self.prefer.as_str() {
+            "text" => false,
+            "image" => true,
+            s => bail!(r#"Invalid prefer "{s}", should be "text" or "image""#),
+        };
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_TEE") {
+            self.tee = parse_osstr(s)?;
+        }
+        let tee = SyncTypes::parse(&self.tee)?;
+        if tee.file {
+            bail!(r#"Invalid tee type "file", the files received are always written to dir"#);
+        }
+        if let Some(s) = env::var_os("CSYNC_CONFIG_TEE_NAME") {
+            self.tee_name = parse_osstr(s)?;
+        }
+        let tee_name = NameTemplate::parse(&self.tee_name).context("Invalid tee name")?;
+
+        if let Some(s) = env::var_os("CSYNC_CONFIG_HISTORY") {
+            let history = parse_osstr(s)?;
+            self.history = history.parse().context("Could not parse history")?;
+        }
+
         Ok(Config {
             bind,
             targets,
             interval: self.interval,
+            idle_interval: self.idle_interval,
             dir,
             conn_max: self.conn_max,
             conn_live: self.conn_live,
+            channel_size: self.channel_size,
+            backpressure,
+            max_bandwidth: self.max_bandwidth,
+            hash_algo,
+            read_only: self.read_only,
+            write_only: self.write_only,
+            types,
+            schedule,
+            max_frame_size: self.max_frame_size,
+            allow_plain: self.allow_plain,
+            write_retry: self.write_retry,
+            write_idle: self.write_idle,
+            strip_url_tracking: self.strip_url_tracking,
+            log_preview: self.log_preview,
+            recv_limit,
+            conflict,
+            observe: self.observe,
+            timeout: self.timeout,
+            prefer_image,
+            tee,
+            tee_name,
+            history: self.history,
+            templates: self.templates.clone(),
             auth_key,
         })
     }
 }
 
+/// Replace the `${VAR}` references in `s` with the values of environment
+/// variables, `$$` is replaced with `$`.
+pub fn expand_env(s: &str) -> Result<String> {
+    let mut result = String::with_capacity(s.len());
+    let mut rest = s;
+    while let Some(pos) = rest.find('$') {
+        result.push_str(&rest[..pos]);
+        rest = &rest[pos + 1..];
+        if let Some(stripped) = rest.strip_prefix('$') {
+            result.push('$');
+            rest = stripped;
+            continue;
+        }
+        if !rest.starts_with('{') {
+            result.push('$');
+            continue;
+        }
+        let end = match rest.find('}') {
+            Some(end) => end,
+            None => bail!(r#"Unclosed "${{""#),
+        };
+        let name = &rest[1..end];
+        if name.is_empty() {
+            bail!(r#"Empty env name in "${{}}""#);
+        }
+        match env::var_os(name) {
+            Some(value) => result.push_str(&parse_osstr(value)?),
+            None => bail!(r#"Env "{name}" is not set"#),
+        }
+        rest = &rest[end + 1..];
+    }
+    result.push_str(rest);
+    Ok(result)
+}
+
+/// Parse the template values like "name=value".
+pub fn parse_vars(vars: &[String]) -> Result<HashMap<String, String>> {
+    let mut result = HashMap::with_capacity(vars.len());
+    for var in vars {
+        match var.split_once('=') {
+            Some((name, value)) if !name.is_empty() => {
+                result.insert(name.to_string(), value.to_string());
+            }
+            _ => bail!(r#"Invalid var "{var}", should be like "name=value""#),
+        }
+    }
+    Ok(result)
+}
+
+pub fn parse_bool(s: &str) -> Result<bool> {
+    match s {
+        "true" | "1" => Ok(true),
+        "false" | "0" => Ok(false),
+        _ => bail!(r#"Invalid bool value "{s}", should be "true" or "false""#),
+    }
+}
+
 pub fn parse_osstr(s: OsString) -> Result<String> {
     match s.to_str() {
         Some(s) => Ok(s.to_string()),
@@ -0,0 +1,259 @@
+use std::collections::VecDeque;
+use std::fmt;
+use std::fs;
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Local};
+use human_bytes::human_bytes;
+use log::warn;
+use serde::{Deserialize, Serialize};
+use tokio::fs::OpenOptions;
+use tokio::io::AsyncWriteExt;
+
+/// Whether the data was sent to the targets or received from a peer.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Direction {
+    Sent,
+    Received,
+}
+
+/// A record of the data sent or received.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Entry {
+    /// In RFC 3339 format.
+    pub time: String,
+    pub direction: Direction,
+    /// The address of the peer that sent the data, only for the received
+    /// data.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub from: Option<String>,
+
+    /// The data type, "text", "image" or "file".
+    #[serde(rename = "type")]
+    pub data_type: String,
+    pub size: usize,
+    pub hash: String,
+
+    /// The content of text data.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub text: Option<String>,
+    /// The name of file data.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+}
+
+impl Entry {
+    /// The max number of characters of the text to show in a line.
+    const TEXT_PREVIEW_SIZE: usize = 60;
+
+    pub fn new(direction: Direction, data_type: &str, size: usize, hash: String) -> Entry {
+        Entry {
+            time: Local::now().to_rfc3339(),
+            direction,
+            from: None,
+            data_type: data_type.to_string(),
+            size,
+            hash,
+            text: None,
+            name: None,
+        }
+    }
+}
+
+impl fmt::Display for Entry {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let time = match DateTime::parse_from_rfc3339(&self.time) {
+            Ok(time) => time
+                .with_timezone(&Local)
+                .format("%Y-%m-%d %H:%M:%S")
+                .to_string(),
+            Err(_) => self.time.clone(),
+        };
+        let direction = match self.direction {
+            Direction::Sent => "sent",
+            Direction::Received => "recv",
+        };
+        let from = self.from.as_deref().unwrap_or("-");
+        let size = human_bytes(self.size as u32);
+        write!(
+            f,
+            "{time}  {direction}  {from:<21}  {:<5}  {size:>10}  {}",
+            self.data_type, self.hash
+        )?;
+        if let Some(name) = &self.name {
+            write!(f, "  {name}")?;
+        }
+        if let Some(text) = &self.text {
+            let preview: String = text.chars().take(Self::TEXT_PREVIEW_SIZE).collect();
+            let ellipsis = if preview.len() < text.len() {
+                "..."
+            } else {
+                ""
+            };
+            write!(f, "  `{}`{ellipsis}", preview.escape_debug())?;
+        }
+        Ok(())
+    }
+}
+
+/// The history of the data sent and received, stored in a json lines file
+/// under the data dir. Only the latest `cap` entries are kept.
+///
+/// New entries are appended to the file, which is rewritten with the entries
+/// kept once it grows to twice `cap` lines, so that recording an entry does
+/// not have to rewrite the whole file.
+///
+/// The text copied may be a password, the file is only readable by the
+/// owner.
+pub struct History {
+    path: PathBuf,
+    cap: usize,
+
+    entries: VecDeque<Entry>,
+    /// The number of lines in the file.
+    lines: usize,
+}
+
+impl History {
+    const FILE_NAME: &str = "history.jsonl";
+    const FILE_MODE: u32 = 0o600;
+
+    /// Open the history under `dir`, keeping at most `cap` entries.
+    pub fn open(dir: &Path, cap: usize) -> Result<History> {
+        let path = dir.join(Self::FILE_NAME);
+        let (entries, lines) = Self::read(&path)?;
+
+        // The file written by older versions may be readable by others.
+        #[cfg(unix)]
+        if lines > 0 {
+            use std::os::unix::fs::PermissionsExt;
+            let perm = fs::Permissions::from_mode(Self::FILE_MODE);
+            fs::set_permissions(&path, perm)
+                .with_context(|| format!("Set mode of history {}", path.display()))?;
+        }
+
+        let mut history = History {
+            path,
+            cap,
+            entries: entries.into(),
+            lines,
+        };
+        while history.entries.len() > cap {
+            history.entries.pop_front();
+        }
+        Ok(history)
+    }
+
+    /// Load the entries in the history under `dir`, the oldest first.
+    pub fn load(dir: &Path) -> Result<Vec<Entry>> {
+        let (entries, _) = Self::read(&dir.join(Self::FILE_NAME))?;
+        Ok(entries)
+    }
+
+    /// Read the entries and the number of lines in the file, the broken lines,
+    /// e.g. written during a crash, are ignored with a warning.
+    fn read(path: &Path) -> Result<(Vec<Entry>, usize)> {
+        let data = match fs::read_to_string(path) {
+            Ok(data) => data,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok((Vec::new(), 0)),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Read history {}", path.display()))
+            }
+        };
+
+        let mut entries = Vec::new();
+        let mut lines = 0;
+        for (idx, line) in data.lines().enumerate() {
+            lines += 1;
+            match serde_json::from_str(line) {
+                Ok(entry) => entries.push(entry),
+                Err(err) => warn!(
+                    "Invalid history entry at {}:{}, ignored: {err}",
+                    path.display(),
+                    idx + 1
+                ),
+            }
+        }
+        Ok((entries, lines))
+    }
+
+    /// Add an entry to the history, and drop the oldest one if the history is
+    /// full.
+    pub async fn record(&mut self, entry: Entry) -> Result<()> {
+        let mut line = serde_json::to_string(&entry).context("Encode history entry")?;
+        line.push('\n');
+        self.entries.push_back(entry);
+        if self.entries.len() > self.cap {
+            self.entries.pop_front();
+        }
+
+        if self.lines + 1 > self.cap * 2 {
+            return self.rewrite().await;
+        }
+        let mut file = Self::open_file(OpenOptions::new().append(true), &self.path).await?;
+        // The tokio file writes in the background, flush to wait for it.
+        file.write_all(line.as_bytes())
+            .await
+            .with_context(|| format!("Write history {}", self.path.display()))?;
+        file.flush()
+            .await
+            .with_context(|| format!("Write history {}", self.path.display()))?;
+        self.lines += 1;
+        Ok(())
+    }
+
+    /// Rewrite the file with the entries kept, through a temporary file so
+    /// that the history is not lost if csync stops in the middle. Like the
+    /// files received, the temporary file is synced to the disk before it is
+    /// renamed, otherwise a crash could leave an empty history.
+    async fn rewrite(&mut self) -> Result<()> {
+        let mut data = String::new();
+        for entry in &self.entries {
+            data.push_str(&serde_json::to_string(entry).context("Encode history entry")?);
+            data.push('\n');
+        }
+
+        let tmp_path = self.path.with_extension("jsonl.csync-tmp");
+        let result = Self::write_file(&tmp_path, data.as_bytes()).await;
+        let result = match result {
+            Ok(()) => tokio::fs::rename(&tmp_path, &self.path)
+                .await
+                .with_context(|| format!("Rename history to {}", self.path.display())),
+            Err(err) => Err(err),
+        };
+        if result.is_err() {
+            let _ = tokio::fs::remove_file(&tmp_path).await;
+        }
+        result?;
+        self.lines = self.entries.len();
+        Ok(())
+    }
+
+    async fn write_file(path: &Path, data: &[u8]) -> Result<()> {
+        // A file left by an earlier crash would keep its old mode.
+        let _ = tokio::fs::remove_file(path).await;
+
+        let mut file = Self::open_file(OpenOptions::new().write(true).truncate(true), path).await?;
+        file.write_all(data)
+            .await
+            .with_context(|| format!("Write history {}", path.display()))?;
+        file.sync_all()
+            .await
+            .with_context(|| format!("Sync history {}", path.display()))?;
+        Ok(())
+    }
+
+    async fn open_file(opts: &mut OpenOptions, path: &Path) -> Result<tokio::fs::File> {
+        opts.create(true);
+
+        #[cfg(unix)]
+        opts.mode(Self::FILE_MODE);
+
+        opts.open(path)
+            .await
+            .with_context(|| format!("Open history {}", path.display()))
+    }
+}
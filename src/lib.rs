@@ -1,2 +1,6 @@
+pub mod config;
+pub mod history;
 pub mod net;
+pub mod schedule;
 pub mod server;
+pub mod sync;
@@ -1,16 +1,19 @@
 mod config;
+mod history;
 mod net;
+mod schedule;
 mod server;
 mod sync;
 
 use std::io::{self, Write};
+use std::path::Path;
 use std::process::ExitCode;
 
-use anyhow::Result;
-use clap::Parser;
+use anyhow::{bail, Context, Result};
 use config::Arg;
 use log::debug;
 
+use crate::history::History;
 use crate::server::Server;
 use crate::sync::Synchronizer;
 
@@ -24,12 +27,35 @@ async fn run() -> Result<()> {
         .format_module_path(false)
         .init();
 
-    let mut arg = Arg::parse();
+    let mut arg = Arg::load()?;
     let cfg = arg.normalize()?;
     debug!("Use config: {:?}", cfg);
 
+    if arg.list_history {
+        for entry in History::load(&cfg.dir)? {
+            println!("{entry}");
+        }
+        return Ok(());
+    }
+
+    if let Some(name) = &arg.template {
+        let template = match cfg.templates.get(name) {
+            Some(template) => template,
+            None => bail!(r#"Could not find template "{name}""#),
+        };
+        let vars = config::parse_vars(&arg.var)?;
+        let text = sync::expand_template(template, &vars, prompt)?;
+        return sync::send_text(&cfg, text).await;
+    }
+
+    if let Some(file) = &arg.file {
+        return sync::send_file(&cfg, Path::new(file)).await;
+    }
+
     let (mut syncer, sender) = Synchronizer::new(&cfg).await?;
     let mut server = Server::new(&cfg.bind, sender, cfg.conn_max as usize).await?;
+    server.with_max_frame_size(cfg.max_frame_size);
+    server.with_allow_plain(cfg.allow_plain);
     if let Some(auth_key) = &cfg.auth_key {
         server.with_auth(auth_key.clone());
         syncer.with_auth(auth_key.clone());
@@ -40,6 +66,19 @@ async fn run() -> Result<()> {
     server.run().await
 }
 
+/// Ask the value of a template placeholder on the terminal.
+fn prompt(name: &str) -> Result<String> {
+    let mut stderr = io::stderr();
+    write!(stderr, "{name}: ")?;
+    stderr.flush()?;
+
+    let mut line = String::new();
+    io::stdin().read_line(&mut line).context("Read input")?;
+    Ok(line
+        .trim_end_matches(|c| c == '\r' || c == '\n')
+        .to_string())
+}
+
 #[tokio::main]
 async fn main() -> ExitCode {
     match run().await {
@@ -1,14 +1,16 @@
 use std::fmt;
-use std::io::Cursor;
+use std::future::Future;
+use std::io::{self, Cursor};
 use std::net::SocketAddr;
 
-use aes_gcm::aead::{Aead, AeadCore, KeyInit, OsRng};
+use aes_gcm::aead::{AeadCore, AeadInPlace, KeyInit, OsRng};
 use aes_gcm::{Aes256Gcm, Key};
 use anyhow::{bail, Context, Result};
 use bytes::{Buf, Bytes, BytesMut};
 use thiserror::Error;
 use tokio::io::{AsyncReadExt, AsyncWriteExt, BufWriter};
 use tokio::net::{TcpSocket, TcpStream};
+use tokio::time::{self, Duration, Instant};
 
 #[derive(Error, Debug)]
 pub enum Error {
@@ -19,8 +21,18 @@ pub enum Error {
     #[error("Protocol error: {0}")]
     Protocol(String),
 
-    #[error("Auth message error")]
+    #[error("Auth message error, the password may be incorrect")]
     Auth,
+
+    /// The peer sent plain data, but we require encryption.
+    #[error(
+        "Received unencrypted data, but a password is configured, the peer may have no password"
+    )]
+    Unencrypted,
+
+    /// The peer sent encrypted data, but we have no password to decrypt it.
+    #[error("Received encrypted data, but no password is configured")]
+    Encrypted,
 }
 
 /// Auth uses the AES256-GCM algorithm to encrypt and decrypt data.
@@ -30,6 +42,18 @@ pub struct Auth {
 }
 
 impl Auth {
+    const NONCE_SIZE: usize = 12;
+    const TAG_SIZE: usize = 16;
+
+    /// The min size of the encrypted data, with empty plain data.
+    const MIN_SIZE: usize = Self::NONCE_SIZE + Self::TAG_SIZE;
+
+    /// The nonce starts with this marker, the rest of it is random. It tells
+    /// the encrypted data apart from the plain data, which can be any bytes
+    /// for files. The marker is never valid utf-8. The data encrypted by older
+    /// versions has a fully random nonce, and no marker.
+    const MARKER: [u8; 4] = [0xc0, b'c', b's', b'y'];
+
     /// Create a new Auth object with the given key, note that the length of
     /// `auth_key` must be 32, otherwise the function will panic.
     ///
@@ -52,34 +76,55 @@ impl Auth {
     }
 
     fn encrypt(&self, plain: &[u8]) -> Result<Vec<u8>, Error> {
-        let nonce = Aes256Gcm::generate_nonce(&mut OsRng);
-        let mut data = match self.cipher.encrypt(&nonce, plain) {
-            Ok(data) => data,
+        // Encrypt in place so that the output buffer is allocated only once,
+        // the layout is: nonce | cipher data | tag.
+        let mut nonce = Aes256Gcm::generate_nonce(&mut OsRng);
+        nonce[..Self::MARKER.len()].copy_from_slice(&Self::MARKER);
+        let mut data = Vec::with_capacity(Self::NONCE_SIZE + plain.len() + Self::TAG_SIZE);
+        data.extend_from_slice(&nonce);
+        data.extend_from_slice(plain);
+
+        let cipher_data = &mut data[Self::NONCE_SIZE..];
+        let tag = match self
+            .cipher
+            .encrypt_in_place_detached(&nonce, b"", cipher_data)
+        {
+            Ok(tag) => tag,
             Err(_) => return Err(Error::Auth),
         };
-        data.splice(..0, nonce);
+        data.extend_from_slice(&tag);
         Ok(data)
     }
 
+    /// Whether the data is encrypted by us, see `MARKER`.
+    fn is_marked(data: &[u8]) -> bool {
+        data.len() >= Self::MIN_SIZE && data.starts_with(&Self::MARKER)
+    }
+
     fn decrypt(&self, data: &[u8]) -> Result<Vec<u8>, Error> {
-        // The header must be a random nonce of length 12. If the length is
-        // shorter than 12, the data is not encrypted.
-        if data.len() <= 12 {
+        // The header must be a random nonce of length 12, and the tail must be
+        // a tag of length 16. If the data is shorter than this, the data is not
+        // encrypted.
+        if data.len() < Self::MIN_SIZE {
             return Err(Error::Auth);
         }
 
-        let nonce = &data[..12];
-        let cipher_data = &data[12..];
+        let (nonce, cipher_data) = data.split_at(Self::NONCE_SIZE);
+        let (cipher_data, tag) = cipher_data.split_at(cipher_data.len() - Self::TAG_SIZE);
 
-        match self.cipher.decrypt(nonce.into(), cipher_data) {
-            Ok(plain) => Ok(plain),
+        let mut plain = cipher_data.to_vec();
+        match self
+            .cipher
+            .decrypt_in_place_detached(nonce.into(), b"", &mut plain, tag.into())
+        {
+            Ok(()) => Ok(plain),
             Err(_) => Err(Error::Auth),
         }
     }
 }
 
 /// A frame in the csync protocol.
-#[derive(Debug)]
+#[derive(Debug, Clone)]
 pub enum Frame {
     Text(String),
     Image(u64, u64, Bytes),
@@ -89,6 +134,12 @@ pub enum Frame {
 struct FrameParser<'a> {
     cursor: Cursor<&'a [u8]>,
     auth: Option<&'a Auth>,
+
+    /// The max size of the data in a frame.
+    max_size: usize,
+
+    /// Accept unencrypted frames even if `auth` is set.
+    allow_plain: bool,
 }
 
 impl<'a> FrameParser<'a> {
@@ -96,15 +147,28 @@ impl<'a> FrameParser<'a> {
     pub const PROTOCOL_IMAGE: u8 = b'i';
     pub const PROTOCOL_FILE: u8 = b'f';
 
-    fn new(buffer: &BytesMut) -> FrameParser {
+    /// The max length of a line (decimal or file name). A peer sending a longer
+    /// line is broken or malicious, we must not buffer it forever.
+    const MAX_LINE_SIZE: usize = 4096;
+
+    /// The max unix file mode, includes the permission and special bits.
+    const MAX_FILE_MODE: u64 = 0o7777;
+    /// Only the permission bits of the file mode are kept, a peer must not be
+    /// able to create setuid or setgid files.
+    const FILE_MODE_MASK: u64 = 0o777;
+
+    fn new(buffer: &BytesMut, max_size: usize) -> FrameParser {
         FrameParser {
             cursor: Cursor::new(&buffer[..]),
             auth: None,
+            max_size,
+            allow_plain: false,
         }
     }
 
-    fn with_auth(&mut self, auth: &'a Auth) {
+    fn with_auth(&mut self, auth: &'a Auth, allow_plain: bool) {
         self.auth = Some(auth);
+        self.allow_plain = allow_plain;
     }
 
     fn parse(&mut self) -> Result<Option<(Frame, usize)>, Error> {
@@ -159,7 +223,7 @@ impl<'a> FrameParser<'a> {
             }
             Self::PROTOCOL_FILE => {
                 self.get_line()?; // file name
-                self.get_decimal()?; // file mode
+                self.get_file_mode()?;
                 self.check_data()
             }
             actual => Err(Error::Protocol(format!("invalid frame type `{actual}`"))),
@@ -169,21 +233,29 @@ impl<'a> FrameParser<'a> {
     fn parse_frame(&mut self) -> Result<Frame, Error> {
         match self.get_u8()? {
             Self::PROTOCOL_TEXT => {
-                let data = self.get_data()?;
+                let data = self.get_data(Self::is_utf8)?;
+                if self.auth.is_none() && !Self::is_utf8(&data) && data.len() >= Auth::MIN_SIZE {
+                    // The text is always utf-8, unlike the encrypted data.
+                    return Err(Error::Encrypted);
+                }
                 let text = self.parse_string(&data)?;
                 Ok(Frame::Text(text))
             }
             Self::PROTOCOL_IMAGE => {
                 let width = self.get_decimal()?;
                 let height = self.get_decimal()?;
-                let data = self.get_data()?;
+                let size = width.checked_mul(height).and_then(|n| n.checked_mul(4));
+                let data = self.get_data(|data| size == Some(data.len() as u64))?;
                 Ok(Frame::Image(width, height, data))
             }
             Self::PROTOCOL_FILE => {
                 let name_data = self.get_line()?;
                 let name = self.parse_string(name_data)?;
-                let mode = self.get_decimal()? as u32;
-                let data = self.get_data()?;
+                let mode = self.get_file_mode()?;
+                let data = self.get_data(|data| !Auth::is_marked(data))?;
+                if self.auth.is_none() && Auth::is_marked(&data) {
+                    return Err(Error::Encrypted);
+                }
 
                 Ok(Frame::File(name, mode, data))
             }
@@ -199,21 +271,49 @@ impl<'a> FrameParser<'a> {
     }
 
     fn check_data(&mut self) -> Result<(), Error> {
-        let len = self.get_decimal()? as usize;
+        let len = self.get_data_size()?;
         self.skip(len + 2)?;
         Ok(())
     }
 
+    fn get_data_size(&mut self) -> Result<usize, Error> {
+        // Check the size before waiting for the data, otherwise a bad size
+        // makes us buffer gigabytes of data.
+        let len = self.get_decimal()?;
+        if len > self.max_size as u64 {
+            return Err(Error::Protocol(format!(
+                "data size {len} exceeds the limit {}",
+                self.max_size
+            )));
+        }
+        Ok(len as usize)
+    }
+
+    fn get_file_mode(&mut self) -> Result<u32, Error> {
+        let mode = self.get_decimal()?;
+        if mode > Self::MAX_FILE_MODE {
+            return Err(Error::Protocol(format!("invalid file mode {mode:o}")));
+        }
+        Ok((mode & Self::FILE_MODE_MASK) as u32)
+    }
+
     fn get_line(&mut self) -> Result<&'a [u8], Error> {
+        let buffer = *self.cursor.get_ref();
         let start = self.cursor.position() as usize;
-        let end = self.cursor.get_ref().len() - 1;
+        let end = buffer.len().saturating_sub(1);
 
         for i in start..end {
-            if self.cursor.get_ref()[i] == b'\r' && self.cursor.get_ref()[i + 1] == b'\n' {
+            if buffer[i] == b'\r' && buffer[i + 1] == b'\n' {
+                if i - start > Self::MAX_LINE_SIZE {
+                    break;
+                }
                 self.cursor.set_position((i + 2) as u64);
-                return Ok(&self.cursor.get_ref()[start..i]);
+                return Ok(&buffer[start..i]);
             }
         }
+        if buffer.len() - start > Self::MAX_LINE_SIZE {
+            return Err(Error::Protocol("line too long".into()));
+        }
         Err(Error::Incomplete)
     }
 
@@ -226,18 +326,41 @@ impl<'a> FrameParser<'a> {
         }
     }
 
-    fn get_data(&mut self) -> Result<Bytes, Error> {
-        let len = self.get_decimal()? as usize;
-        let n = len + 2 as usize;
+    /// Get the data of the frame, decrypted if `auth` is set. `is_plain` tells
+    /// whether the data is unencrypted data of this frame type: utf-8 text, an
+    /// image of width*height*4 bytes, or a file without `Auth::MARKER`. The
+    /// frame type does not say whether its data is encrypted, so when the
+    /// decryption fails, this is how a peer without password is told apart
+    /// from a peer with a wrong one.
+    fn get_data<F>(&mut self, is_plain: F) -> Result<Bytes, Error>
+    where
+        F: FnOnce(&[u8]) -> bool,
+    {
+        let len = self.get_data_size()?;
+        let n = len + 2;
 
         if self.cursor.remaining() < len {
             return Err(Error::Incomplete);
         }
 
-        let mut data = Bytes::copy_from_slice(&self.cursor.chunk()[..len]);
-        if let Some(auth) = self.auth {
-            data = auth.decrypt(&data)?.into();
-        }
+        // Decrypt directly from the read buffer, so that the data is copied
+        // only once in both cases.
+        let raw = &self.cursor.chunk()[..len];
+        let data = match self.auth {
+            Some(auth) => match auth.decrypt(raw) {
+                Ok(data) => data.into(),
+                // The encrypted data is never shorter than the nonce and tag,
+                // and never looks like plain data, see `is_plain`.
+                Err(_) if raw.len() < Auth::MIN_SIZE || is_plain(raw) => {
+                    if !self.allow_plain {
+                        return Err(Error::Unencrypted);
+                    }
+                    Bytes::copy_from_slice(raw)
+                }
+                Err(err) => return Err(err),
+            },
+            None => Bytes::copy_from_slice(raw),
+        };
 
         // skip that number of bytes + 2 (\r\n)
         self.skip(n)?;
@@ -253,6 +376,10 @@ impl<'a> FrameParser<'a> {
         Ok(())
     }
 
+    fn is_utf8(data: &[u8]) -> bool {
+        std::str::from_utf8(data).is_ok()
+    }
+
     fn parse_string(&self, data: &[u8]) -> Result<String, Error> {
         match String::from_utf8(data.to_vec()) {
             Ok(text) => Ok(text),
@@ -299,6 +426,12 @@ pub struct Connection {
 
     /// The auther.
     auth: Option<Auth>,
+
+    /// The max size of the data in a frame.
+    max_frame_size: usize,
+
+    /// Accept unencrypted frames even if auth is set.
+    allow_plain: bool,
 }
 
 impl Connection {
@@ -307,6 +440,9 @@ impl Connection {
     /// But for images, the buffer needs to be expanded.
     const BUFFER_SIZE: usize = 32 << 10;
 
+    /// The default max size of the data in a frame, 256MiB.
+    pub const MAX_FRAME_SIZE: usize = 256 << 20;
+
     /// Create a new `Connection`, backed by `socket`. Read and write buffers
     /// are initialized.
     pub fn new(socket: TcpStream) -> Connection {
@@ -314,6 +450,8 @@ impl Connection {
             stream: BufWriter::new(socket),
             buffer: BytesMut::with_capacity(Self::BUFFER_SIZE),
             auth: None,
+            max_frame_size: Self::MAX_FRAME_SIZE,
+            allow_plain: false,
         }
     }
 
@@ -322,6 +460,18 @@ impl Connection {
         self.auth = Some(auth);
     }
 
+    /// Limit the size of the data in a frame, a frame exceeding it is treated
+    /// as a protocol error, and no memory is allocated for it.
+    pub fn with_max_frame_size(&mut self, size: usize) {
+        self.max_frame_size = size;
+    }
+
+    /// Accept unencrypted frames even if auth is set, by default they are
+    /// rejected.
+    pub fn with_allow_plain(&mut self, allow: bool) {
+        self.allow_plain = allow;
+    }
+
     /// Read a single `Frame` value from the underlying stream.
     ///
     /// The function waits until it has retrieved enough data to parse a frame.
@@ -335,9 +485,9 @@ impl Connection {
     /// `None`. Otherwise, an error is returned.
     pub async fn read_frame(&mut self) -> Result<Option<Frame>> {
         loop {
-            let mut parser = FrameParser::new(&self.buffer);
+            let mut parser = FrameParser::new(&self.buffer, self.max_frame_size);
             if let Some(auth) = &self.auth {
-                parser.with_auth(auth);
+                parser.with_auth(auth, self.allow_plain);
             }
             // Attempt to parse a frame from the buffered data. If enough data
             // has been buffered, the frame is returned.
@@ -374,9 +524,24 @@ impl Connection {
 pub struct Client {
     stream: BufWriter<TcpStream>,
     auth: Option<Auth>,
+
+    /// The max bytes per second to write, `None` means unlimited.
+    bandwidth: Option<u64>,
+
+    /// The max time to wait for each write to make progress, `None` means
+    /// waiting forever.
+    timeout: Option<Duration>,
 }
 
 impl Client {
+    /// When the bandwidth is limited, the data is written in chunks no larger
+    /// than this size, default is 16KiB.
+    const THROTTLE_CHUNK_SIZE: u64 = 16 << 10;
+
+    /// When the bandwidth is unlimited, the data is written in chunks of this
+    /// size, default is 64KiB.
+    const WRITE_CHUNK_SIZE: u64 = 64 << 10;
+
     pub async fn dial(addr: &SocketAddr) -> Result<Client> {
         let socket = if addr.is_ipv4() {
             TcpSocket::new_v4()
@@ -384,6 +549,9 @@ impl Client {
             TcpSocket::new_v6()
         }
         .context("Create tcp socket")?;
+        // Let the system probe the idle connections kept in the pool, so that
+        // the ones silently dropped by a NAT are eventually torn down.
+        socket.set_keepalive(true).context("Enable tcp keepalive")?;
         let stream = socket
             .connect(addr.clone())
             .await
@@ -391,6 +559,8 @@ impl Client {
         Ok(Client {
             stream: BufWriter::new(stream),
             auth: None,
+            bandwidth: None,
+            timeout: None,
         })
     }
 
@@ -398,6 +568,34 @@ impl Client {
         self.auth = Some(auth);
     }
 
+    /// Check whether the connection can still be used. The peer never writes
+    /// to a client, so if the stream becomes readable, the peer has closed or
+    /// reset the connection, e.g. it was restarted. Writing to such a
+    /// connection may succeed locally while the data is lost.
+    pub fn is_alive(&self) -> bool {
+        let mut buf = [0; 1];
+        match self.stream.get_ref().try_read(&mut buf) {
+            Err(err) => err.kind() == io::ErrorKind::WouldBlock,
+            Ok(_) => false,
+        }
+    }
+
+    /// Limit the write rate to `bytes_per_sec`, zero means unlimited.
+    pub fn with_bandwidth(&mut self, bytes_per_sec: u64) {
+        self.bandwidth = match bytes_per_sec {
+            0 => None,
+            n => Some(n),
+        };
+    }
+
+    /// Fail a write if no data could be written for `timeout`, e.g. the peer
+    /// is gone without closing the connection. The timeout applies to each
+    /// chunk rather than the whole frame, so that a large frame under a low
+    /// bandwidth does not time out as long as it keeps moving.
+    pub fn with_timeout(&mut self, timeout: Option<Duration>) {
+        self.timeout = timeout;
+    }
+
     #[allow(dead_code)]
     pub async fn dial_string<S: AsRef<str>>(addr: S) -> Result<Client> {
         let addr: SocketAddr = addr
@@ -441,7 +639,9 @@ impl Client {
         // Ensure the encoded frame is written to the socket. The calls above
         // are to the buffered stream and writes. Calling `flush` writes the
         // remaining contents of the buffer to the socket.
-        self.stream.flush().await.context("Flush stream")
+        io_timeout(self.timeout, self.stream.flush())
+            .await
+            .context("Flush stream")
     }
 
     async fn write_line(&mut self, line: &String) -> Result<()> {
@@ -454,15 +654,43 @@ impl Client {
         if let Some(auth) = &self.auth {
             let cipher_data = auth.encrypt(data)?;
             self.write_decimal(cipher_data.len() as u64).await?;
-            self.stream.write_all(&cipher_data).await?;
+            self.write_throttled(&cipher_data).await?;
         } else {
             self.write_decimal(data.len() as u64).await?;
-            self.stream.write_all(data).await?;
+            self.write_throttled(data).await?;
         }
         self.stream.write_all(b"\r\n").await?;
         Ok(())
     }
 
+    /// Write data to the stream in chunks, each chunk must be written within
+    /// the timeout. If the bandwidth is limited, after each chunk is flushed,
+    /// we wait until the time it is worth under the bandwidth has passed.
+    async fn write_throttled(&mut self, data: &[u8]) -> Result<()> {
+        let bandwidth = match self.bandwidth {
+            Some(bandwidth) => bandwidth,
+            None => {
+                for chunk in data.chunks(Self::WRITE_CHUNK_SIZE as usize) {
+                    io_timeout(self.timeout, self.stream.write_all(chunk)).await?;
+                }
+                return Ok(());
+            }
+        };
+
+        // Write at least 10 chunks per second, so that the traffic is smooth
+        // even for low bandwidth.
+        let chunk_size = (bandwidth / 10).clamp(1, Self::THROTTLE_CHUNK_SIZE);
+        for chunk in data.chunks(chunk_size as usize) {
+            let start = Instant::now();
+            io_timeout(self.timeout, self.stream.write_all(chunk)).await?;
+            io_timeout(self.timeout, self.stream.flush()).await?;
+
+            let cost = Duration::from_secs_f64(chunk.len() as f64 / bandwidth as f64);
+            time::sleep_until(start + cost).await;
+        }
+        Ok(())
+    }
+
     async fn write_decimal(&mut self, val: u64) -> Result<()> {
         use std::io::Write;
 
@@ -478,3 +706,17 @@ impl Client {
         Ok(())
     }
 }
+
+/// Wait for the io to complete, fail if it takes longer than `timeout`.
+async fn io_timeout<T, F>(timeout: Option<Duration>, io: F) -> Result<T>
+where
+    F: Future<Output = io::Result<T>>,
+{
+    let result = match timeout {
+        Some(timeout) => time::timeout(timeout, io)
+            .await
+            .with_context(|| format!("Write timeout after {timeout:?}"))?,
+        None => io.await,
+    };
+    Ok(result?)
+}
@@ -0,0 +1,132 @@
+use std::fmt;
+
+use anyhow::{bail, Context, Result};
+use chrono::{Datelike, Local, NaiveTime, Timelike, Weekday};
+
+/// The time window to sync clipboard, outside of it, the clipboard changes are
+/// not sent, and the data received is dropped. This prevents a work machine's
+/// clipboard from leaking into personal machines off-hours.
+#[derive(Debug, Clone)]
+pub struct Schedule {
+    /// The start and end minute of the day, if `start > end`, the window
+    /// crosses midnight. They are equal only when there is no limit of hours.
+    start: u32,
+    end: u32,
+
+    /// Indexed by the number of days from Monday.
+    days: [bool; 7],
+}
+
+impl Schedule {
+    const WEEKDAYS: [&str; 7] = ["mon", "tue", "wed", "thu", "fri", "sat", "sun"];
+
+    /// Parse the schedule from hours like "09:00-18:00" and days like
+    /// "mon-fri" or "mon,wed,fri". Empty hours or days means no limit.
+    pub fn parse(hours: &str, days: &str) -> Result<Schedule> {
+        let (start, end) = if hours.is_empty() {
+            (0, 0)
+        } else {
+            let (start, end) = match hours.split_once('-') {
+                Some(range) => range,
+                None => bail!(r#"Invalid active hours "{hours}", should be like "09:00-18:00""#),
+            };
+            let start = Self::parse_minute(start)
+                .with_context(|| format!(r#"Invalid active hours "{hours}""#))?;
+            let end = Self::parse_minute(end)
+                .with_context(|| format!(r#"Invalid active hours "{hours}""#))?;
+            if start == end {
+                bail!(
+                    r#"Invalid active hours "{hours}", the start and end are the same, leave it empty for all day"#
+                );
+            }
+            (start, end)
+        };
+
+        let days = if days.is_empty() {
+            [true; 7]
+        } else {
+            Self::parse_days(days).with_context(|| format!(r#"Invalid active days "{days}""#))?
+        };
+
+        Ok(Schedule { start, end, days })
+    }
+
+    fn parse_minute(s: &str) -> Result<u32> {
+        let time = NaiveTime::parse_from_str(s.trim(), "%H:%M")
+            .with_context(|| format!(r#"Invalid time "{s}", should be like "09:00""#))?;
+        Ok(time.hour() * 60 + time.minute())
+    }
+
+    fn parse_days(s: &str) -> Result<[bool; 7]> {
+        let mut days = [false; 7];
+        for item in s.split(',') {
+            let (first, last) = match item.split_once('-') {
+                Some((first, last)) => (Self::parse_day(first)?, Self::parse_day(last)?),
+                None => {
+                    let day = Self::parse_day(item)?;
+                    (day, day)
+                }
+            };
+            if first > last {
+                bail!(r#"Invalid day range "{item}""#);
+            }
+            for day in first..=last {
+                days[day] = true;
+            }
+        }
+        Ok(days)
+    }
+
+    fn parse_day(s: &str) -> Result<usize> {
+        let s = s.trim();
+        match Self::WEEKDAYS.iter().position(|day| *day == s) {
+            Some(idx) => Ok(idx),
+            None => bail!(r#"Invalid day "{s}", should be one of "mon", "tue", ... "sun""#),
+        }
+    }
+
+    /// Return whether the local time now is in the window.
+    pub fn is_active(&self) -> bool {
+        let now = Local::now();
+        let minute = now.hour() * 60 + now.minute();
+        self.contains(now.weekday(), minute)
+    }
+
+    /// Return whether the `minute` of the day on `weekday` is in the window.
+    pub fn contains(&self, weekday: Weekday, minute: u32) -> bool {
+        if self.start == self.end {
+            return self.days[weekday.num_days_from_monday() as usize];
+        }
+        if self.start < self.end {
+            return self.days[weekday.num_days_from_monday() as usize]
+                && minute >= self.start
+                && minute < self.end;
+        }
+        // The window crosses midnight, the part after midnight belongs to the
+        // day before.
+        if minute >= self.start {
+            return self.days[weekday.num_days_from_monday() as usize];
+        }
+        minute < self.end && self.days[weekday.pred().num_days_from_monday() as usize]
+    }
+}
+
+impl fmt::Display for Schedule {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let days: Vec<&str> = Self::WEEKDAYS
+            .iter()
+            .zip(self.days.iter())
+            .filter(|(_, active)| **active)
+            .map(|(day, _)| *day)
+            .collect();
+        write!(
+            f,
+            "{:02}:{:02}-{:02}:{:02} on {}",
+            self.start / 60,
+            self.start % 60,
+            self.end / 60,
+            self.end % 60,
+            days.join(",")
+        )
+    }
+}
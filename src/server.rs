@@ -27,20 +27,31 @@ pub struct Server {
     /// to the semaphore.
     conn_limit: Arc<Semaphore>,
 
-    /// Use to send synchronization requests to clipboard synchronizer.
-    sender: Sender<Frame>,
+    /// Use to send synchronization requests to clipboard synchronizer, with
+    /// the address of the peer they come from.
+    sender: Sender<(SocketAddr, Frame)>,
 
     /// The server bind address.
     bind: SocketAddr,
 
     /// The auth key.
     auth_key: Option<Vec<u8>>,
+
+    /// The max size of the data in a frame.
+    max_frame_size: usize,
+
+    /// Accept unencrypted frames even if auth is set.
+    allow_plain: bool,
 }
 
 impl Server {
     const ACCEPT_TCP_MAX_BACKOFF: u64 = 64;
 
-    pub async fn new(bind: &SocketAddr, sender: Sender<Frame>, max_conn: usize) -> Result<Server> {
+    pub async fn new(
+        bind: &SocketAddr,
+        sender: Sender<(SocketAddr, Frame)>,
+        max_conn: usize,
+    ) -> Result<Server> {
         let listener = TcpListener::bind(bind)
             .await
             .with_context(|| format!(r#"Bind "{}""#, bind))?;
@@ -53,6 +64,8 @@ impl Server {
             sender,
             bind: bind.clone(),
             auth_key: None,
+            max_frame_size: Connection::MAX_FRAME_SIZE,
+            allow_plain: false,
         })
     }
 
@@ -60,6 +73,14 @@ impl Server {
         self.auth_key = Some(auth_key);
     }
 
+    pub fn with_max_frame_size(&mut self, size: usize) {
+        self.max_frame_size = size;
+    }
+
+    pub fn with_allow_plain(&mut self, allow: bool) {
+        self.allow_plain = allow;
+    }
+
     pub async fn run(&mut self) -> Result<()> {
         info!("Start to listen `{}`", self.bind);
         loop {
@@ -85,6 +106,8 @@ impl Server {
             if let Some(auth_key) = &self.auth_key {
                 conn.with_auth(Auth::new(auth_key));
             }
+            conn.with_max_frame_size(self.max_frame_size);
+            conn.with_allow_plain(self.allow_plain);
 
             tokio::spawn(async move {
                 debug!("Accpect connection from {addr}");
@@ -117,7 +140,11 @@ impl Server {
         }
     }
 
-    async fn handle(sender: Sender<Frame>, mut conn: Connection, addr: SocketAddr) -> Result<()> {
+    async fn handle(
+        sender: Sender<(SocketAddr, Frame)>,
+        mut conn: Connection,
+        addr: SocketAddr,
+    ) -> Result<()> {
         loop {
             let frame = conn.read_frame().await?;
 
@@ -133,7 +160,10 @@ impl Server {
             };
 
             debug!("Recv {frame} from {addr}");
-            sender.send(frame).await.context("Send frame to channel")?;
+            sender
+                .send((addr, frame))
+                .await
+                .context("Send frame to channel")?;
         }
     }
 }
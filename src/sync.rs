@@ -1,25 +1,37 @@
 use core::fmt;
 use std::borrow::Cow;
-use std::collections::HashMap;
+use std::collections::{HashMap, VecDeque};
 use std::io;
 use std::net::SocketAddr;
-use std::path::PathBuf;
+use std::path::{Component, Path, PathBuf};
+use std::sync::{Arc, Mutex};
 
-use anyhow::{anyhow, Context, Result};
+use anyhow::{anyhow, bail, Context, Result};
 use arboard::Clipboard;
+use chrono::Local;
 use human_bytes::human_bytes;
-use log::{debug, error, info};
+use log::{debug, error, info, warn};
 use tokio::fs::{self, OpenOptions};
 use tokio::io::AsyncWriteExt;
 use tokio::sync::mpsc::{self, Receiver, Sender};
+use tokio::sync::watch;
 use tokio::time::{self, Duration, Instant, Interval};
 
 use crate::config::Config;
+use crate::history::{Direction, Entry, History};
 use crate::net::{Auth, Client, Frame};
 
 /// Such error returns from `arboard` should be ignored.
 const INCORRECT_CLIPBOARD_TYPE_ERROR: &str = "incorrect type received from clipboard";
 
+/// The query parameters used to track clicks, they are stripped from the urls
+/// sent if `strip_url_tracking` is enabled. Besides, all the parameters with
+/// the "utm_" prefix are stripped.
+const URL_TRACKING_PARAMS: &[&str] = &[
+    "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "mc_cid", "mc_eid", "igshid",
+    "yclid", "twclid", "_hsenc", "_hsmi", "mkt_tok",
+];
+
 /// A synchronizer does two things:
 ///
 /// 1. Watch the data change of the system clipboard, if there is a change, send
@@ -27,84 +39,146 @@ const INCORRECT_CLIPBOARD_TYPE_ERROR: &str = "incorrect type received from clipb
 /// 2. Receive the synchronization request sent from the server and write it to the
 /// system clipboard.
 pub struct Synchronizer {
-    /// Client connection pool. Clients in the connection pool will be reused.
-    /// But if the client is not used for a period of time, it will be recycled.
-    conn_pool: HashMap<String, Client>,
-    /// Record the time when the corresponding client will be recycled.
-    conn_expire: HashMap<String, Instant>,
+    /// Pass the frames to send to the `TargetSender` of each target.
+    targets: Vec<watch::Sender<Option<Frame>>>,
 
-    /// The hash value of the data in the current clipboard.
-    current_hash: Option<String>,
+    /// The hash of the clipboard content, either read from it or written to
+    /// it by us. Only this one is suppressed, an older content copied again,
+    /// or received again, must still be synced.
+    last_hash: Option<String>,
+    /// The hashes of the data recently written by us, see `HashCache`.
+    written: HashCache,
+    /// The algorithm to calculate the hash values.
+    hash_algo: HashAlgo,
 
-    /// The `arboard` clipboard driver.
-    clipboard: Clipboard,
+    /// The clipboard driver, `SystemClipboard` by default.
+    clipboard: Box<dyn ClipboardDriver>,
 
     /// Used to receive external synchronization requests from the server. Recv
     /// Data will be written to the system clipboard using `arboard`.
-    receiver: Receiver<Frame>,
+    receiver: Receiver<(SocketAddr, Frame)>,
 
     /// The interval to watch the clipboard changes.
     clipboard_intv: Interval,
-    /// The interval to watch the client expirations.
-    expire_intv: Interval,
-    /// The client expiration time.
-    expire_duration: Duration,
+    /// The normal and idle durations of `clipboard_intv`.
+    clipboard_duration: Duration,
+    idle_duration: Option<Duration>,
+    /// The last time the clipboard changed, used to detect idle.
+    last_change: Instant,
+    /// Whether `clipboard_intv` is currently using the idle duration.
+    idle: bool,
+    /// The last time the clipboard was changed locally, rather than by the
+    /// data received, used to resolve conflicts.
+    last_local_change: Option<Instant>,
+    /// Only write the data received after the clipboard has not been changed
+    /// locally for this long.
+    write_idle: Option<Duration>,
+    /// The data received waiting for the clipboard to be idle, and the time
+    /// to write it.
+    deferred: Option<(ClipboardData, Instant)>,
+
+    /// The max number of characters of the text to show in logs.
+    log_preview: usize,
+
+    /// The number of files written by tee, used in their names.
+    tee_seq: u64,
+
+    /// The history of the data sent and received, `None` if disabled.
+    history: Option<History>,
 
     /// The auth key.
     auth_key: Option<Vec<u8>>,
 }
 
 impl Synchronizer {
+    /// If the clipboard does not change for this long, switch to the idle
+    /// interval to watch it.
+    const IDLE_TIMEOUT: Duration = Duration::from_secs(60);
+
+    /// The interval to retry a clipboard write that did not take effect.
+    const WRITE_RETRY_INTERVAL: Duration = Duration::from_millis(100);
+
+    /// The mode of the files written by tee, the clipboard data may be a
+    /// password, so only the owner can read them.
+    const TEE_FILE_MODE: u32 = 0o600;
+
+    /// The data received within this time after a local change is treated as
+    /// a conflict with it.
+    const CONFLICT_WINDOW: Duration = Duration::from_secs(2);
+
     /// Create a synchronizer, you should call `run` to enable it.
     /// The sender returned by this method can be used to send synchronization
     /// request to the synchronizer.
-    pub async fn new(cfg: &Config) -> Result<(Synchronizer, Sender<Frame>)> {
-        let conn_pool = HashMap::with_capacity(cfg.targets.len());
-        let conn_expire = HashMap::with_capacity(cfg.targets.len());
-
+    pub async fn new(cfg: &Config) -> Result<(Synchronizer, Sender<(SocketAddr, Frame)>)> {
         // Initialize the `arboard` clipboard driver. This library does not provide
         // a universal read method, so some inelegant encapsulation is required.
         // But there are no other clipboard drivers that are maintained and
         // available in the Rust community.
         // We can wait issue: https://github.com/1Password/arboard/issues/11
-        let mut clipboard = Clipboard::new().context("Init clipboard driver")?;
+        let clipboard = SystemClipboard::new(cfg.prefer_image)?;
+        Self::with_driver(cfg, Box::new(clipboard)).await
+    }
 
+    /// Create a synchronizer with the given clipboard driver, see `new`.
+    pub async fn with_driver(
+        cfg: &Config,
+        mut clipboard: Box<dyn ClipboardDriver>,
+    ) -> Result<(Synchronizer, Sender<(SocketAddr, Frame)>)> {
         // Use `mpsc` so that we can have multi senders hold by different
         // tokio tasks.
         // For server situation, each connection should have one sender.
-        let (sender, receiver) = mpsc::channel::<Frame>(cfg.conn_max as usize);
+        let (sender, receiver) = mpsc::channel::<(SocketAddr, Frame)>(cfg.channel_size);
 
         // Read the data of the current clipboard as the initial value. This causes
         // that the initial sync request is not sent immediately after csync
         // starts. This is to prevent a flood of sync requests when csync keeps
         // restarting.
-        let current = ClipboardData::read(&mut clipboard).context("Read clipboard")?;
-        let current_hash = match current {
-            Some(data) => Some(data.get_hash()),
-            None => None,
+        let current = clipboard.read().context("Read clipboard")?;
+        let last_hash = current.map(|data| data.get_hash(cfg.hash_algo));
+
+        let history = match cfg.history {
+            0 => None,
+            cap => Some(History::open(&cfg.dir, cap)?),
         };
 
         // Init some time values.
         let start = Instant::now();
         let clipboard_duration = Duration::from_millis(cfg.interval);
-        let expire_duration = Duration::from_secs(cfg.conn_live as u64);
+        let idle_duration = match cfg.idle_interval {
+            0 => None,
+            idle => Some(Duration::from_millis(idle)),
+        };
 
         let clipboard_intv = time::interval_at(start, clipboard_duration);
-        let expire_intv = time::interval_at(start, expire_duration);
 
         let syncer = Synchronizer {
-            conn_pool,
-            conn_expire,
+            targets: Vec::with_capacity(cfg.targets.len()),
 
-            current_hash,
+            last_hash,
+            written: HashCache::new(HashCache::CAPACITY),
+            hash_algo: cfg.hash_algo,
 
             clipboard,
 
             receiver,
 
             clipboard_intv,
-            expire_intv,
-            expire_duration,
+            clipboard_duration,
+            idle_duration,
+            last_change: start,
+            idle: false,
+            last_local_change: None,
+            write_idle: match cfg.write_idle {
+                0 => None,
+                idle => Some(Duration::from_millis(idle)),
+            },
+            deferred: None,
+
+            log_preview: cfg.log_preview,
+
+            tee_seq: 0,
+
+            history,
 
             auth_key: None,
         };
@@ -119,34 +193,73 @@ impl Synchronizer {
     /// Start the clipboard synchronization process. This should run in a
     /// standalone tokio task.
     pub async fn run(&mut self, cfg: &Config) {
-        if cfg.targets.is_empty() {
+        if cfg.observe {
+            info!("Observe only, nothing will be sent or written");
+        }
+        if cfg.targets.is_empty() || cfg.write_only {
             return self.readonly_run(cfg).await;
         }
 
+        for target in &cfg.targets {
+            let (sender, receiver) = watch::channel(None);
+            let target = TargetSender::new(*target, cfg, self.auth_key.clone(), receiver);
+            tokio::spawn(target.run());
+            self.targets.push(sender);
+        }
+
         use tokio::select;
 
         info!("Start to sync clipboard");
         loop {
+            let write_at = match &self.deferred {
+                Some((_, write_at)) => *write_at,
+                None => Instant::now(),
+            };
             select! {
                 _ = self.clipboard_intv.tick() => {
                     // Read the data of the clipboard, if there is a change, send
                     // a synchronization request to targets.
-                    if let Err(err) = self.send_clipboard_data(&cfg.targets).await {
+                    if let Err(err) = self.send_clipboard_data(cfg).await {
                         error!("Send clipboard error: {err:#}");
                     }
-                }
-                _ = self.expire_intv.tick() => {
-                    // Periodically close those expired connections, this is
-                    // controlled by the `Config.conn_live`.
-                    self.clean_conn();
+                    self.update_clipboard_intv();
                 }
                 frame = self.receiver.recv() => {
                     self.recv_frame(frame, cfg).await;
                 }
+                _ = time::sleep_until(write_at), if self.deferred.is_some() => {
+                    self.write_deferred(cfg).await;
+                }
             }
         }
     }
 
+    /// Slow down watching the clipboard when it has been idle for a while,
+    /// and restore the normal interval once it changes again. Reading the
+    /// clipboard is not free, this keeps the CPU usage low while idle.
+    fn update_clipboard_intv(&mut self) {
+        let idle_duration = match self.idle_duration {
+            Some(duration) => duration,
+            None => return,
+        };
+
+        let idle = self.last_change.elapsed() >= Self::IDLE_TIMEOUT;
+        if idle == self.idle {
+            return;
+        }
+        self.idle = idle;
+
+        let duration = if idle {
+            debug!("Clipboard is idle, watch it every {idle_duration:?}");
+            idle_duration
+        } else {
+            self.clipboard_duration
+        };
+        self.clipboard_intv = time::interval_at(Instant::now() + duration, duration);
+    }
+
+    /// Only receive frames, without watching the clipboard. This is used when
+    /// there is no target, or write-only is enabled.
     async fn readonly_run(&mut self, cfg: &Config) {
         info!("Start to sync clipboard (readonly)");
         loop {
@@ -155,108 +268,355 @@ impl Synchronizer {
         }
     }
 
-    async fn recv_frame(&mut self, frame: Option<Frame>, cfg: &Config) {
+    async fn recv_frame(&mut self, frame: Option<(SocketAddr, Frame)>, cfg: &Config) {
         if let Some(frame) = frame {
-            if let Frame::File(name, mode, data) = &frame {
-                // Handle the file synchronization request.
-                if let Err(err) = self.recv_file(&cfg.dir, name, *mode, data).await {
-                    error!("Recv data error: {err:#}");
-                }
-            }
-            // Handle the clipboard synchronization request.
-            if let Err(err) = self.recv_clipboard(frame) {
-                error!("Recv clipboard error: {err:#}");
+            for (addr, frame) in self.drain_frames(frame, cfg.backpressure) {
+                self.handle_frame(addr, frame, cfg).await;
             }
         }
     }
 
-    async fn get_conn(&mut self, target: &SocketAddr) -> Result<Client> {
-        let addr = target.to_string();
-        if let Some(conn) = self.conn_pool.remove(&addr) {
-            // If there is an available connection in the connection pool, take it
-            // out of the pool directly, and put it back into the connection pool
-            // after use.
-            return Ok(conn);
+    /// Take the frames piled up in the channel behind `first`, and apply the
+    /// backpressure policy to them. The newest frame is always kept, and file
+    /// frames are never dropped.
+    fn drain_frames(
+        &mut self,
+        first: (SocketAddr, Frame),
+        policy: Backpressure,
+    ) -> Vec<(SocketAddr, Frame)> {
+        let mut frames = vec![first];
+        if let Backpressure::Block = policy {
+            return frames;
         }
-
-        // No available connection, create a new one.
-        debug!("Create connection to {target}");
-        let mut client = Client::dial(target).await?;
-        if let Some(auth_key) = &self.auth_key {
-            client.with_auth(Auth::new(auth_key));
+        while let Ok(frame) = self.receiver.try_recv() {
+            frames.push(frame);
         }
 
-        Ok(client)
-    }
+        let total = frames.len();
+        let frames: Vec<(SocketAddr, Frame)> = frames
+            .into_iter()
+            .enumerate()
+            .filter(|(idx, (_, frame))| {
+                if *idx == total - 1 {
+                    return true;
+                }
+                match (policy, frame) {
+                    (_, Frame::File(..)) => true,
+                    (Backpressure::DropImagesFirst, Frame::Text(_)) => true,
+                    _ => false,
+                }
+            })
+            .map(|(_, frame)| frame)
+            .collect();
 
-    fn save_conn(&mut self, target: &SocketAddr, conn: Client) {
-        let addr = target.to_string();
-        self.conn_pool.insert(addr.clone(), conn);
-        // The expiration time is: now + conn_live
-        let expire = Instant::now().checked_add(self.expire_duration).unwrap();
-        self.conn_expire.insert(addr, expire);
+        let dropped = total - frames.len();
+        if dropped > 0 {
+            warn!("Writing clipboard falls behind, drop {dropped} frame(s)");
+        }
+        frames
     }
 
-    fn clean_conn(&mut self) {
-        let now = Instant::now();
-        let mut clean = Vec::new();
-        for (addr, expire) in &self.conn_expire {
-            if now >= *expire {
-                debug!("Drop expired client {addr}");
-                self.conn_pool.remove(addr);
-                clean.push(addr.clone());
+    /// Handle the `frame` received from the peer at `addr`.
+    async fn handle_frame(&mut self, addr: SocketAddr, frame: Frame, cfg: &Config) {
+        if let Some(schedule) = &cfg.schedule {
+            if !schedule.is_active() {
+                debug!("Drop {frame}, out of active time {schedule}");
+                return;
+            }
+        }
+        if let Frame::File(name, mode, data) = &frame {
+            if !cfg.types.file {
+                debug!("Skip writing {frame}, file is not synced");
+                return;
+            }
+            if cfg.observe {
+                info!("Would write {frame} to file");
+                return;
+            }
+            // Handle the file synchronization request.
+            if let Err(err) = self.recv_file(&cfg.dir, name, *mode, data).await {
+                error!("Recv data error: {err:#}");
+                return;
             }
+            let mut hash = self.hash_algo.digest(data);
+            hash.truncate(ClipboardData::LOG_HASH_SIZE);
+            let mut entry = Entry::new(Direction::Received, "file", data.len(), hash);
+            entry.from = Some(addr.to_string());
+            entry.name = Some(name.clone());
+            self.record_history(entry).await;
+            return;
         }
-        for addr in clean {
-            self.conn_expire.remove(&addr);
+        if cfg.read_only {
+            debug!("Skip writing {frame} to clipboard, read-only is enabled");
+            return;
+        }
+        if !cfg.types.contains(&frame) {
+            debug!("Skip writing {frame} to clipboard, its type is not synced");
+            return;
+        }
+        if let Err(err) = cfg.recv_limit.check(&frame) {
+            warn!("Skip writing {frame} to clipboard, {err:#}");
+            return;
+        }
+        if let ConflictPolicy::PreferLocal = cfg.conflict {
+            let conflict = self
+                .last_local_change
+                .map(|t| t.elapsed() < Self::CONFLICT_WINDOW)
+                .unwrap_or(false);
+            if conflict {
+                debug!("Skip writing {frame} to clipboard, it conflicts with the local change");
+                return;
+            }
+        }
+        if cfg.observe {
+            info!("Would write {frame} to clipboard");
+            return;
+        }
+        // Handle the clipboard synchronization request.
+        if let Err(err) = self.recv_clipboard(addr, frame, cfg).await {
+            error!("Recv clipboard error: {err:#}");
         }
     }
 
-    async fn send_clipboard_data(&mut self, targets: &[SocketAddr]) -> Result<()> {
+    async fn send_clipboard_data(&mut self, cfg: &Config) -> Result<()> {
         // `data` may be an image or text, but we don't care in this method,
         // all conversions have been done in ClipboardData.
-        let data = match ClipboardData::read(&mut self.clipboard)? {
+        let mut data = match self.clipboard.read()? {
             Some(data) => data,
             // No data in clipboard, skip this loop.
             None => return Ok(()),
         };
-        let hash = data.get_hash();
-        if let Some(current_hash) = &self.current_hash {
-            if current_hash.eq(&hash) {
-                // If the hash value has not changed, it means that the content
-                // in the clipboard has not changed, and we skip this loop directly.
+        let synced = match &data {
+            ClipboardData::Text(_) => cfg.types.text,
+            ClipboardData::Image(..) => cfg.types.image,
+        };
+        if !synced {
+            return Ok(());
+        }
+        let hash = data.get_hash(self.hash_algo);
+        if self.last_hash.as_ref() == Some(&hash) {
+            // The content has not changed at all, or it was written by us.
+            // Skip this loop directly. The clipboard has settled on it, so
+            // the older writes can not be read back any more.
+            self.written.clear();
+            return Ok(());
+        }
+        if self.written.contains(&hash) {
+            // A late read of an older write by us, not a local change.
+            return Ok(());
+        }
+        self.written.clear();
+        self.last_hash = Some(hash);
+        self.last_change = Instant::now();
+        self.last_local_change = Some(self.last_change);
+        debug!(
+            "Clipboard changed: {}",
+            data.log_string(self.hash_algo, self.log_preview)
+        );
+        self.drop_stale_frames(cfg).await;
+
+        if let Some(schedule) = &cfg.schedule {
+            if !schedule.is_active() {
+                // The hash is recorded above, so the data will not be sent when
+                // the active time begins either.
+                debug!("Skip sending, out of active time {schedule}");
                 return Ok(());
             }
         }
-        self.current_hash = Some(hash);
-        debug!("Clipboard changed: {data}");
 
-        // TODO: Asynchronously send synchronous requests for each target
+        if cfg.strip_url_tracking {
+            if let ClipboardData::Text(text) = &data {
+                if let Some(url) = strip_url_tracking(text) {
+                    debug!("Strip the tracking parameters from url");
+                    data = ClipboardData::Text(url);
+                }
+            }
+        }
+        if !cfg.observe {
+            // Record what is actually sent, without the tracking parameters.
+            let entry = data.history_entry(Direction::Sent, self.hash_algo);
+            self.record_history(entry).await;
+        }
+
         let frame = data.to_frame();
-        for target in targets {
-            debug!("Send {frame} to {target}");
-            let mut conn = self.get_conn(target).await?;
-            conn.write_frame(&frame).await?;
-            self.save_conn(target, conn);
+        if observe_send(cfg, &frame) {
+            return Ok(());
+        }
+        for target in &self.targets {
+            target.send_replace(Some(frame.clone()));
         }
 
         Ok(())
     }
 
-    fn recv_clipboard(&mut self, frame: Frame) -> Result<()> {
+    /// Drop the clipboard frames waiting in the channel, and the data waiting
+    /// for the clipboard to be idle, when the local clipboard changes. They
+    /// were received before the change was detected, writing them would
+    /// overwrite the fresh local data moments later. File frames do not touch
+    /// the clipboard, they are handled as usual.
+    async fn drop_stale_frames(&mut self, cfg: &Config) {
+        let mut dropped = 0;
+        if self.deferred.take().is_some() {
+            dropped += 1;
+        }
+        while let Ok((addr, frame)) = self.receiver.try_recv() {
+            if let Frame::File(..) = frame {
+                self.handle_frame(addr, frame, cfg).await;
+                continue;
+            }
+            dropped += 1;
+        }
+        if dropped > 0 {
+            debug!("Clipboard changed locally, drop {dropped} stale frame(s)");
+        }
+    }
+
+    async fn recv_clipboard(&mut self, addr: SocketAddr, frame: Frame, cfg: &Config) -> Result<()> {
+        if let Frame::Image(width, height, data) = &frame {
+            // The clipboard expects RGBA pixels, a mismatched size would make
+            // it read out of the buffer.
+            let size = width.checked_mul(*height).and_then(|n| n.checked_mul(4));
+            if size != Some(data.len() as u64) {
+                bail!(
+                    "Invalid image {width}x{height}, the data size {} does not match",
+                    data.len()
+                );
+            }
+        }
+        let tee = cfg.tee.contains(&frame);
         let data = ClipboardData::from_frame(frame);
-        let hash = data.get_hash();
-        if let Some(current_hash) = &self.current_hash {
-            if current_hash.eq(&hash) {
+        if self.last_hash.as_ref() == Some(&data.get_hash(self.hash_algo)) {
+            // The clipboard holds the data already.
+            return Ok(());
+        }
+        let mut entry = data.history_entry(Direction::Received, self.hash_algo);
+        entry.from = Some(addr.to_string());
+        self.record_history(entry).await;
+        if tee {
+            // A failed copy should not stop the data from reaching the
+            // clipboard.
+            if let Err(err) = self.tee_data(cfg, &data).await {
+                error!("Tee data error: {err:#}");
+            }
+        }
+        if let (Some(idle), Some(last)) = (self.write_idle, self.last_local_change) {
+            // Do not take the clipboard from the user in the middle of a copy,
+            // some platforms hand the ownership of it to the writer. The write
+            // is deferred rather than waited for, so that the clipboard is
+            // still watched meanwhile, see `write_deferred`.
+            let write_at = last + idle;
+            if write_at > Instant::now() {
+                let wait = write_at - Instant::now();
+                debug!("Clipboard was changed locally just now, wait {wait:?} to write");
+                self.deferred = Some((data, write_at));
                 return Ok(());
             }
         }
-        self.current_hash = Some(hash);
-        debug!("Write {data} to clipboard");
-        data.save(&mut self.clipboard).context("Save clipboard")?;
+        self.write_received(&data, cfg.write_retry).await
+    }
+
+    /// Write the deferred data once the clipboard has been idle long enough.
+    /// A local change meanwhile drops the data, see `drop_stale_frames`, so
+    /// the clipboard is checked once more right before writing.
+    async fn write_deferred(&mut self, cfg: &Config) {
+        if let Err(err) = self.send_clipboard_data(cfg).await {
+            error!("Send clipboard error: {err:#}");
+        }
+        let data = match self.deferred.take() {
+            Some((data, _)) => data,
+            None => return,
+        };
+        if let Err(err) = self.write_received(&data, cfg.write_retry).await {
+            error!("Recv clipboard error: {err:#}");
+        }
+    }
+
+    async fn write_received(&mut self, data: &ClipboardData, retry: u32) -> Result<()> {
+        debug!(
+            "Write {} to clipboard",
+            data.log_string(self.hash_algo, self.log_preview)
+        );
+        let current = self.write_clipboard(data, retry).await?;
+        // Not to send the data back when it is read from the clipboard. The
+        // data read back may differ from the written one for images.
+        let hash = current.as_ref().unwrap_or(data).get_hash(self.hash_algo);
+        self.written.insert(hash.clone());
+        self.last_hash = Some(hash);
+        self.last_change = Instant::now();
         Ok(())
     }
 
+    /// Write data to the clipboard, then read it back to verify the write. On
+    /// some Linux setups the write silently does nothing, so it is retried at
+    /// most `retry` times. Zero `retry` disables the verification. Images are
+    /// verified by the dimensions only, see `ClipboardData::written_as`.
+    /// Returns the data read back, `None` if it is not verified.
+    async fn write_clipboard(
+        &mut self,
+        data: &ClipboardData,
+        retry: u32,
+    ) -> Result<Option<ClipboardData>> {
+        let mut count = 0;
+        loop {
+            self.clipboard.write(data).context("Save clipboard")?;
+            if retry == 0 {
+                return Ok(None);
+            }
+
+            let current = self.clipboard.read().context("Read clipboard to verify")?;
+            if let Some(current) = current {
+                if current.written_as(data) {
+                    return Ok(Some(current));
+                }
+            }
+            if count >= retry {
+                bail!("Write clipboard did not take effect after {count} retries");
+            }
+            count += 1;
+            warn!("Write clipboard did not take effect, retry {count}/{retry}");
+            time::sleep(Self::WRITE_RETRY_INTERVAL).await;
+        }
+    }
+
+    /// Add an entry to the history, if it is enabled. A failure is only
+    /// logged, the sync goes on without it.
+    async fn record_history(&mut self, entry: Entry) {
+        if let Some(history) = self.history.as_mut() {
+            if let Err(err) = history.record(entry).await {
+                error!("Record history error: {err:#}");
+            }
+        }
+    }
+
+    /// Write a copy of the clipboard data received to a file under `cfg.dir`,
+    /// named by `cfg.tee_name`. The images are written as raw RGBA pixels.
+    async fn tee_data(&mut self, cfg: &Config, data: &ClipboardData) -> Result<()> {
+        let (kind, dims, ext, bytes) = match data {
+            ClipboardData::Text(text) => ("text", String::new(), "txt", text.as_bytes()),
+            ClipboardData::Image(width, height, data) => (
+                "image",
+                format!("-{width}x{height}"),
+                "rgba",
+                data.as_slice(),
+            ),
+        };
+        self.tee_seq += 1;
+        let now = Local::now();
+        let hash = data.short_hash(self.hash_algo);
+
+        let name = cfg.tee_name.render(&[
+            ("type", kind.to_string()),
+            ("date", now.format("%Y-%m-%d").to_string()),
+            ("time", now.format("%Y%m%d-%H%M%S%.3f").to_string()),
+            ("seq", self.tee_seq.to_string()),
+            ("hash", hash),
+            ("dims", dims),
+            ("ext", ext.to_string()),
+        ]);
+        self.recv_file(&cfg.dir, &name, Self::TEE_FILE_MODE, bytes)
+            .await
+    }
+
     async fn recv_file(
         &mut self,
         dir: &PathBuf,
@@ -264,6 +624,11 @@ impl Synchronizer {
         mode: u32,
         data: &[u8],
     ) -> Result<()> {
+        // The name comes from the peer, do not let it write outside the dir.
+        let is_normal = |c: Component| matches!(c, Component::Normal(_));
+        if name.is_empty() || !Path::new(name).components().all(is_normal) {
+            bail!("Invalid file name {name:?}, should be a relative path without '..'");
+        }
         let path = dir.join(name);
         let dir = path.parent();
         debug!(
@@ -286,6 +651,28 @@ impl Synchronizer {
             }
         }
 
+        // Write to a temporary file and rename it, so that a crash in the
+        // middle never leaves a truncated file for others to pick up.
+        let mut tmp_name = path.file_name().unwrap_or_default().to_os_string();
+        tmp_name.push(".csync-tmp");
+        let tmp_path = path.with_file_name(tmp_name);
+        let result = Self::write_file(&tmp_path, mode, data).await;
+        let result = match result {
+            Ok(()) => fs::rename(&tmp_path, &path)
+                .await
+                .with_context(|| format!("Rename file to {}", path.display())),
+            Err(err) => Err(err),
+        };
+        if result.is_err() {
+            let _ = fs::remove_file(&tmp_path).await;
+        }
+        result
+    }
+
+    async fn write_file(path: &Path, mode: u32, data: &[u8]) -> Result<()> {
+        // A file left by an earlier crash would keep its old mode.
+        let _ = fs::remove_file(path).await;
+
         let mut opts = OpenOptions::new();
         opts.create(true).write(true).truncate(true);
 
@@ -293,49 +680,738 @@ impl Synchronizer {
         opts.mode(mode);
 
         let mut file = opts
-            .open(&path)
+            .open(path)
             .await
             .with_context(|| format!("Open file {}", path.display()))?;
         file.write_all(data)
             .await
             .with_context(|| format!("Write file {}", path.display()))?;
+        file.sync_all()
+            .await
+            .with_context(|| format!("Sync file {}", path.display()))?;
+
+        Ok(())
+    }
+}
+
+/// Sends the clipboard frames to one target in a standalone task, so that a
+/// slow or unreachable target holds up neither watching the clipboard nor the
+/// other targets.
+///
+/// Only the latest clipboard data matters, so a newer frame replaces the one
+/// not sent yet. A frame that could not be sent stays pending, and is resent
+/// every `RETRY_INTERVAL` until the target is reachable again, e.g. the peer
+/// is a laptop that starts before joining the network.
+struct TargetSender {
+    target: SocketAddr,
+
+    /// Receive the frames to send from the synchronizer.
+    receiver: watch::Receiver<Option<Frame>>,
+    /// The latest frame that could not be sent.
+    pending: Option<Frame>,
+    /// The times the pending frame failed to be sent to a reachable target.
+    failures: u32,
+
+    /// The connection is reused, until it is not used for `conn_live`.
+    conn: Option<Client>,
+    conn_expire: Instant,
+    conn_live: Duration,
+
+    /// The max bytes per second to send.
+    max_bandwidth: u64,
+    /// The timeout to connect, and for each write to make progress.
+    timeout: Option<Duration>,
+
+    /// The auth key.
+    auth_key: Option<Vec<u8>>,
+}
+
+impl TargetSender {
+    /// The interval to resend the pending frame.
+    const RETRY_INTERVAL: Duration = Duration::from_secs(5);
+
+    /// The pending frame is dropped after failing to be sent to a reachable
+    /// target this many times, it would most likely fail again, e.g. the peer
+    /// rejects it for being too large.
+    const MAX_SEND_FAILURES: u32 = 3;
+
+    fn new(
+        target: SocketAddr,
+        cfg: &Config,
+        auth_key: Option<Vec<u8>>,
+        receiver: watch::Receiver<Option<Frame>>,
+    ) -> TargetSender {
+        TargetSender {
+            target,
+            receiver,
+            pending: None,
+            failures: 0,
+            conn: None,
+            conn_expire: Instant::now(),
+            conn_live: Duration::from_secs(cfg.conn_live as u64),
+            max_bandwidth: cfg.max_bandwidth,
+            timeout: match cfg.timeout {
+                0 => None,
+                timeout => Some(Duration::from_secs(timeout)),
+            },
+            auth_key,
+        }
+    }
+
+    async fn run(mut self) {
+        use tokio::select;
+
+        let mut retry_intv = time::interval(Self::RETRY_INTERVAL);
+        loop {
+            select! {
+                changed = self.receiver.changed() => {
+                    // The synchronizer is gone, there is nothing more to send.
+                    if changed.is_err() {
+                        return;
+                    }
+                    self.pending = self.receiver.borrow_and_update().clone();
+                    self.failures = 0;
+                    self.send_pending(false).await;
+                    retry_intv.reset();
+                }
+                _ = retry_intv.tick(), if self.pending.is_some() => {
+                    // The target may be reachable now.
+                    self.send_pending(true).await;
+                }
+                _ = time::sleep_until(self.conn_expire), if self.conn.is_some() => {
+                    // Close the connection not used for a while, this is
+                    // controlled by the `Config.conn_live`.
+                    debug!("Drop expired client {}", self.target);
+                    self.conn = None;
+                }
+            }
+        }
+    }
+
+    /// Send the pending frame. It stays pending if the target is unreachable,
+    /// or is dropped after `MAX_SEND_FAILURES` failures to send it.
+    async fn send_pending(&mut self, retry: bool) {
+        let frame = match self.pending.take() {
+            Some(frame) => frame,
+            None => return,
+        };
+        let target = self.target;
+        debug!("Send {frame} to {target}");
+        let mut conn = match self.get_conn().await {
+            Ok(conn) => conn,
+            Err(err) => {
+                // Only report the first failure, the target may stay
+                // unreachable for a long time, e.g. the peer is offline.
+                if retry {
+                    debug!("Resend {frame} to {target} error: {err:#}");
+                } else {
+                    error!("Send {frame} to {target} error: {err:#}, will retry later");
+                }
+                self.pending = Some(frame);
+                return;
+            }
+        };
+
+        // The connection is dropped if the sending fails, it may have been
+        // left with half a frame written.
+        if let Err(err) = conn.write_frame(&frame).await {
+            self.failures += 1;
+            if self.failures >= Self::MAX_SEND_FAILURES {
+                error!(
+                    "Send {frame} to {target} error: {err:#}, drop it after {} failures",
+                    self.failures
+                );
+                return;
+            }
+            error!("Send {frame} to {target} error: {err:#}, will retry later");
+            self.pending = Some(frame);
+            return;
+        }
+        self.failures = 0;
+        self.conn = Some(conn);
+        // The expiration time is: now + conn_live
+        self.conn_expire = Instant::now() + self.conn_live;
+    }
+
+    async fn get_conn(&mut self) -> Result<Client> {
+        let target = self.target;
+        if let Some(conn) = self.conn.take() {
+            // Reuse the connection, it is put back after use.
+            if conn.is_alive() {
+                return Ok(conn);
+            }
+            debug!("Connection to {target} was closed by peer, reconnect");
+        }
+
+        debug!("Create connection to {target}");
+        connect(
+            &target,
+            self.auth_key.as_ref(),
+            self.max_bandwidth,
+            self.timeout,
+        )
+        .await
+    }
+}
+
+/// Send the file at `path` to all the targets, they write it under their dir
+/// with the same name and permission bits.
+pub async fn send_file(cfg: &Config, path: &Path) -> Result<()> {
+    if cfg.targets.is_empty() {
+        bail!("No target to send the file to");
+    }
+    let name = match path.file_name().and_then(|name| name.to_str()) {
+        Some(name) => name.to_string(),
+        None => bail!("Invalid file path {}", path.display()),
+    };
+    let meta = fs::metadata(path)
+        .await
+        .with_context(|| format!("Read file {}", path.display()))?;
+    if !meta.is_file() {
+        bail!("{} is not a file", path.display());
+    }
+    #[cfg(unix)]
+    let mode = {
+        use std::os::unix::fs::PermissionsExt;
+        // The special bits, e.g. setuid, are not sent, the receiver drops
+        // them anyway.
+        meta.permissions().mode() & 0o777
+    };
+    #[cfg(not(unix))]
+    let mode = 0o644;
+    let data = fs::read(path)
+        .await
+        .with_context(|| format!("Read file {}", path.display()))?;
+
+    send_once(cfg, Frame::File(name, mode, data.into())).await
+}
+
+/// Send `text` to all the targets, see `send_file`.
+pub async fn send_text(cfg: &Config, text: String) -> Result<()> {
+    if cfg.targets.is_empty() {
+        bail!("No target to send the text to");
+    }
+    send_once(cfg, Frame::Text(text)).await
+}
+
+/// Send `frame` to all the targets with new connections. A target that fails
+/// does not stop the frame from being sent to the others. Like the daemon, a
+/// type not synced is refused, and nothing is sent in observe mode.
+async fn send_once(cfg: &Config, frame: Frame) -> Result<()> {
+    if !cfg.types.contains(&frame) {
+        bail!("Could not send {frame}, its type is not in the synced types");
+    }
+    if observe_send(cfg, &frame) {
+        return Ok(());
+    }
+    let mut failed = 0;
+    for target in &cfg.targets {
+        info!("Send {frame} to {target}");
+        if let Err(err) = send_frame_once(cfg, target, &frame).await {
+            error!("Send {frame} to {target} error: {err:#}");
+            failed += 1;
+        }
+    }
+    if failed > 0 {
+        bail!("Could not send to {failed} target(s)");
+    }
+    Ok(())
+}
+
+async fn send_frame_once(cfg: &Config, target: &SocketAddr, frame: &Frame) -> Result<()> {
+    let timeout = match cfg.timeout {
+        0 => None,
+        timeout => Some(Duration::from_secs(timeout)),
+    };
+    let mut client = connect(target, cfg.auth_key.as_ref(), cfg.max_bandwidth, timeout).await?;
+    client.write_frame(frame).await
+}
+
+/// In observe mode, log the frame instead of sending it to the targets. Returns
+/// whether the frame is observed.
+fn observe_send(cfg: &Config, frame: &Frame) -> bool {
+    if !cfg.observe {
+        return false;
+    }
+    for target in &cfg.targets {
+        info!("Would send {frame} to {target}");
+    }
+    true
+}
+
+/// Connect to `target`, the `timeout` applies to the connecting and to each
+/// write of the client, see `Client::with_timeout`.
+async fn connect(
+    target: &SocketAddr,
+    auth_key: Option<&Vec<u8>>,
+    max_bandwidth: u64,
+    timeout: Option<Duration>,
+) -> Result<Client> {
+    let mut client = match timeout {
+        Some(timeout) => time::timeout(timeout, Client::dial(target))
+            .await
+            .with_context(|| format!("Connect timeout after {timeout:?}"))??,
+        None => Client::dial(target).await?,
+    };
+    if let Some(auth_key) = auth_key {
+        client.with_auth(Auth::new(auth_key));
+    }
+    client.with_bandwidth(max_bandwidth);
+    client.with_timeout(timeout);
+    Ok(client)
+}
+
+/// Replace the `{{name}}` placeholders in `template` with the values in
+/// `vars`, the missing ones are asked with `prompt`, once for each name. The
+/// braces that do not form a placeholder, e.g. in code, are kept as is.
+pub fn expand_template<F>(
+    template: &str,
+    vars: &HashMap<String, String>,
+    mut prompt: F,
+) -> Result<String>
+where
+    F: FnMut(&str) -> Result<String>,
+{
+    let mut asked: HashMap<String, String> = HashMap::new();
+    let mut result = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(pos) = rest.find("{{") {
+        result.push_str(&rest[..pos]);
+        rest = &rest[pos..];
+        let end = match rest[2..].find("}}") {
+            Some(end) => end + 2,
+            None => break,
+        };
+        let name = rest[2..end].trim();
+        let is_name = |c: char| c.is_alphanumeric() || c == '_' || c == '-';
+        if name.is_empty() || !name.chars().all(is_name) {
+            result.push_str("{{");
+            rest = &rest[2..];
+            continue;
+        }
+
+        let value = match vars.get(name).or_else(|| asked.get(name)) {
+            Some(value) => value.clone(),
+            None => {
+                let value = prompt(name)?;
+                asked.insert(name.to_string(), value.clone());
+                value
+            }
+        };
+        result.push_str(&value);
+        rest = &rest[end + 2..];
+    }
+    result.push_str(rest);
+    Ok(result)
+}
+
+/// A small cache of the hashes of the data recently written to the clipboard.
+///
+/// Several frames received in a row are written before the clipboard is read
+/// again, and some clipboards return an older write for a while. Such a read
+/// is not a local change, it must not be sent back to the peers.
+///
+/// Only our own writes are cached, and the cache is cleared once the clipboard
+/// changes away from them, either settling on the latest write or changed
+/// locally. Content copied again must still be sent, e.g. when the user
+/// copies A, receives B, then copies A again.
+struct HashCache {
+    /// The most recently written hash is at the front.
+    hashes: VecDeque<String>,
+    cap: usize,
+}
+
+impl HashCache {
+    /// The number of hashes to remember.
+    const CAPACITY: usize = 8;
+
+    fn new(cap: usize) -> HashCache {
+        HashCache {
+            hashes: VecDeque::with_capacity(cap),
+            cap,
+        }
+    }
+
+    /// Record `hash` as the most recent one, the oldest one is dropped once
+    /// the cache is full.
+    fn insert(&mut self, hash: String) {
+        if let Some(pos) = self.hashes.iter().position(|h| h.eq(&hash)) {
+            self.hashes.remove(pos);
+        }
+        if self.hashes.len() >= self.cap {
+            self.hashes.pop_back();
+        }
+        self.hashes.push_front(hash);
+    }
+
+    fn contains(&self, hash: &str) -> bool {
+        self.hashes.iter().any(|h| h == hash)
+    }
+
+    fn clear(&mut self) {
+        self.hashes.clear();
+    }
+}
+
+/// The policy to apply to received frames when writing to the clipboard can
+/// not keep up with the incoming frames.
+#[derive(Debug, Clone, Copy)]
+pub enum Backpressure {
+    /// Keep every frame, the senders wait when the channel is full.
+    Block,
+    /// Only the newest frame is written to the clipboard.
+    DropOldest,
+    /// Image frames are dropped in favor of the newer frames, text frames
+    /// are kept.
+    DropImagesFirst,
+}
 
+impl Backpressure {
+    pub fn parse(s: &str) -> Result<Backpressure> {
+        match s {
+            "block" => Ok(Backpressure::Block),
+            "drop-oldest" => Ok(Backpressure::DropOldest),
+            "drop-images-first" => Ok(Backpressure::DropImagesFirst),
+            _ => bail!(
+                r#"Invalid backpressure "{s}", should be "block", "drop-oldest" or "drop-images-first""#
+            ),
+        }
+    }
+}
+
+/// The policy to resolve the conflict between the data received and a local
+/// change made just before it, e.g. when two machines copy different content
+/// nearly simultaneously.
+#[derive(Debug, Clone, Copy)]
+pub enum ConflictPolicy {
+    /// The data that comes last wins, no matter where it comes from.
+    Latest,
+    /// The local change wins, the data received shortly after it is dropped.
+    PreferLocal,
+}
+
+impl ConflictPolicy {
+    pub fn parse(s: &str) -> Result<ConflictPolicy> {
+        match s {
+            "latest" => Ok(ConflictPolicy::Latest),
+            "prefer-local" => Ok(ConflictPolicy::PreferLocal),
+            _ => bail!(r#"Invalid conflict policy "{s}", should be "latest" or "prefer-local""#),
+        }
+    }
+}
+
+/// The algorithm to calculate the hash of clipboard data. The hash is only used
+/// to detect changes, so a non-cryptographic hash is good enough and is much
+/// faster for large images.
+#[derive(Debug, Clone, Copy)]
+pub enum HashAlgo {
+    Sha256,
+    Xxh3,
+}
+
+impl HashAlgo {
+    pub fn parse(s: &str) -> Result<HashAlgo> {
+        match s {
+            "sha256" => Ok(HashAlgo::Sha256),
+            "xxh3" => Ok(HashAlgo::Xxh3),
+            _ => bail!(r#"Invalid hash "{s}", should be "sha256" or "xxh3""#),
+        }
+    }
+
+    fn digest(&self, data: &[u8]) -> String {
+        match self {
+            HashAlgo::Sha256 => sha256::digest(data),
+            HashAlgo::Xxh3 => format!("{:032x}", xxhash_rust::xxh3::xxh3_128(data)),
+        }
+    }
+}
+
+/// The data types to synchronize.
+#[derive(Debug, Clone, Copy)]
+pub struct SyncTypes {
+    pub text: bool,
+    pub image: bool,
+    pub file: bool,
+}
+
+impl SyncTypes {
+    pub fn parse(s: &str) -> Result<SyncTypes> {
+        let mut types = SyncTypes {
+            text: false,
+            image: false,
+            file: false,
+        };
+        for name in s.split(',') {
+            match name.trim() {
+                "" => {}
+                "text" => types.text = true,
+                "image" => types.image = true,
+                "file" => types.file = true,
+                name => bail!(r#"Invalid type "{name}", should be "text", "image" or "file""#),
+            }
+        }
+        Ok(types)
+    }
+
+    pub fn contains(&self, frame: &Frame) -> bool {
+        match frame {
+            Frame::Text(_) => self.text,
+            Frame::Image(..) => self.image,
+            Frame::File(..) => self.file,
+        }
+    }
+}
+
+/// The limits of the data received to write to the clipboard, so that a peer
+/// can not freeze the paste operations with huge data.
+#[derive(Debug, Clone, Copy)]
+pub struct RecvLimit {
+    /// The max bytes of text, zero means unlimited.
+    pub text: usize,
+    /// The max width and height of images, `None` means unlimited.
+    pub image: Option<(u64, u64)>,
+}
+
+impl RecvLimit {
+    /// Create the limits, `image` is like "3840x2160", empty means unlimited.
+    pub fn parse(text: usize, image: &str) -> Result<RecvLimit> {
+        if image.is_empty() {
+            return Ok(RecvLimit { text, image: None });
+        }
+
+        let invalid =
+            || anyhow!(r#"Invalid image dimensions "{image}", should be like "3840x2160""#);
+        let (width, height) = image.split_once('x').ok_or_else(invalid)?;
+        let width: u64 = width.trim().parse().map_err(|_| invalid())?;
+        let height: u64 = height.trim().parse().map_err(|_| invalid())?;
+        if width == 0 || height == 0 {
+            return Err(invalid());
+        }
+        Ok(RecvLimit {
+            text,
+            image: Some((width, height)),
+        })
+    }
+
+    /// Return an error if `frame` exceeds the limits. Files are not limited
+    /// here, they are not written to the clipboard.
+    pub fn check(&self, frame: &Frame) -> Result<()> {
+        match frame {
+            Frame::Text(text) => {
+                if self.text > 0 && text.len() > self.text {
+                    bail!(
+                        "the text exceeds the limit {}",
+                        human_bytes(self.text as u32)
+                    );
+                }
+            }
+            Frame::Image(width, height, _) => {
+                if let Some((max_width, max_height)) = self.image {
+                    if *width > max_width || *height > max_height {
+                        bail!(
+                            "the image {width}x{height} exceeds the limit {max_width}x{max_height}"
+                        );
+                    }
+                }
+            }
+            Frame::File(..) => {}
+        }
         Ok(())
     }
 }
 
+/// The template of the names of the files written by tee, the placeholders
+/// like `{time}` are replaced with the values of each file.
+#[derive(Debug, Clone)]
+pub struct NameTemplate {
+    template: String,
+}
+
+impl NameTemplate {
+    const PLACEHOLDERS: [&str; 7] = ["type", "date", "time", "seq", "hash", "dims", "ext"];
+
+    pub fn parse(s: &str) -> Result<NameTemplate> {
+        if s.is_empty() {
+            bail!("Empty name template");
+        }
+        let mut rest = s;
+        while let Some(pos) = rest.find('{') {
+            rest = &rest[pos + 1..];
+            let end = match rest.find('}') {
+                Some(end) => end,
+                None => bail!(r#"Unclosed "{{" in name template "{s}""#),
+            };
+            let name = &rest[..end];
+            if !Self::PLACEHOLDERS.contains(&name) {
+                bail!(
+                    r#"Invalid placeholder "{{{name}}}" in name template "{s}", should be one of {}"#,
+                    Self::PLACEHOLDERS.join(", ")
+                );
+            }
+            rest = &rest[end + 1..];
+        }
+        Ok(NameTemplate {
+            template: s.to_string(),
+        })
+    }
+
+    /// Replace the placeholders with the values in `vars`, the ones missing
+    /// from `vars` are replaced with empty strings.
+    pub fn render(&self, vars: &[(&str, String)]) -> String {
+        let mut result = String::with_capacity(self.template.len());
+        let mut rest = self.template.as_str();
+        while let Some(pos) = rest.find('{') {
+            result.push_str(&rest[..pos]);
+            rest = &rest[pos + 1..];
+            // The braces are checked to be closed in `parse`.
+            let end = match rest.find('}') {
+                Some(end) => end,
+                None => break,
+            };
+            let name = &rest[..end];
+            if let Some((_, value)) = vars.iter().find(|(key, _)| *key == name) {
+                result.push_str(value);
+            }
+            rest = &rest[end + 1..];
+        }
+        result.push_str(rest);
+        result
+    }
+}
+
+/// The system clipboard, abstracted so that the synchronizer can run without a
+/// display server, e.g. in tests.
+pub trait ClipboardDriver: Send {
+    /// Read the data in the clipboard, `None` means there is no data, or the
+    /// data type is not supported.
+    fn read(&mut self) -> Result<Option<ClipboardData>>;
+
+    /// Write the data to the clipboard.
+    fn write(&mut self, data: &ClipboardData) -> Result<()>;
+}
+
+/// The system clipboard, accessed with `arboard`.
+pub struct SystemClipboard {
+    inner: Clipboard,
+    /// Read the image first, when the clipboard holds both text and image.
+    prefer_image: bool,
+}
+
+impl SystemClipboard {
+    pub fn new(prefer_image: bool) -> Result<SystemClipboard> {
+        let inner = Clipboard::new().context("Init clipboard driver")?;
+        Ok(SystemClipboard {
+            inner,
+            prefer_image,
+        })
+    }
+}
+
+impl ClipboardDriver for SystemClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        ClipboardData::read(&mut self.inner, self.prefer_image)
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        data.save(&mut self.inner)
+    }
+}
+
+/// An in-memory clipboard driver. The clones share the same data, so a clone
+/// can be used to inspect and change the data the synchronizer sees.
+#[derive(Clone, Default)]
+#[allow(dead_code)]
+pub struct MemoryClipboard {
+    data: Arc<Mutex<Option<ClipboardData>>>,
+}
+
+#[allow(dead_code)]
+impl MemoryClipboard {
+    pub fn new() -> MemoryClipboard {
+        MemoryClipboard::default()
+    }
+
+    pub fn get(&self) -> Option<ClipboardData> {
+        self.data.lock().unwrap().clone()
+    }
+
+    pub fn set(&self, data: ClipboardData) {
+        *self.data.lock().unwrap() = Some(data);
+    }
+}
+
+impl ClipboardDriver for MemoryClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        Ok(self.get())
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        self.set(data.clone());
+        Ok(())
+    }
+}
+
+#[derive(Debug, Clone, PartialEq)]
 pub enum ClipboardData {
     Text(String),
     Image(u64, u64, Vec<u8>),
 }
 
 impl ClipboardData {
-    // If the size of the text exceeds this value, it will be compared using SHA256
-    // hash calculation to reduce memory pressure.
-    const SHA256_TEXT_SIZE: usize = 1024 * 10;
+    /// Return whether the data read back from the clipboard is the `written`
+    /// one. The platforms may convert the pixels of images, e.g. the color
+    /// space or the alpha, so only their dimensions are compared.
+    fn written_as(&self, written: &ClipboardData) -> bool {
+        match (self, written) {
+            (ClipboardData::Text(text), ClipboardData::Text(written)) => text == written,
+            (ClipboardData::Image(width, height, _), ClipboardData::Image(w, h, _)) => {
+                width == w && height == h
+            }
+            _ => false,
+        }
+    }
 
-    pub fn read(cb: &mut Clipboard) -> Result<Option<ClipboardData>> {
-        match cb.get_text() {
-            Ok(text) => return Ok(Some(ClipboardData::Text(text))),
-            Err(err) => {
-                if !Self::ignore_clipboard_error(&err) {
-                    return Err(anyhow!(err));
-                }
+    // If the size of the text exceeds this value, it will be compared using hash
+    // calculation to reduce memory pressure.
+    const HASH_TEXT_SIZE: usize = 1024 * 10;
+
+    /// The number of hash characters to show in logs.
+    const LOG_HASH_SIZE: usize = 16;
+
+    /// Read the data in the clipboard. Some apps put both text and image in
+    /// the clipboard, e.g. a file manager copies the file name and its icon,
+    /// only one of them is read, the text unless `prefer_image` is true.
+    pub fn read(cb: &mut Clipboard, prefer_image: bool) -> Result<Option<ClipboardData>> {
+        if prefer_image {
+            if let Some(data) = Self::read_image(cb)? {
+                return Ok(Some(data));
             }
+            return Self::read_text(cb);
+        }
+        if let Some(data) = Self::read_text(cb)? {
+            return Ok(Some(data));
+        }
+        Self::read_image(cb)
+    }
+
+    fn read_text(cb: &mut Clipboard) -> Result<Option<ClipboardData>> {
+        match cb.get_text() {
+            Ok(text) => Ok(Some(ClipboardData::Text(text))),
+            Err(err) if Self::ignore_clipboard_error(&err) => Ok(None),
+            Err(err) => Err(anyhow!(err)),
         }
+    }
+
+    fn read_image(cb: &mut Clipboard) -> Result<Option<ClipboardData>> {
         match cb.get_image() {
             Ok(image) => {
                 let (width, height) = (image.width as u64, image.height as u64);
                 let data = image.bytes.into_owned();
-                return Ok(Some(ClipboardData::Image(width, height, data)));
-            }
-            Err(err) => {
-                if !Self::ignore_clipboard_error(&err) {
-                    return Err(anyhow!(err));
-                }
+                Ok(Some(ClipboardData::Image(width, height, data)))
             }
+            Err(err) if Self::ignore_clipboard_error(&err) => Ok(None),
+            Err(err) => Err(anyhow!(err)),
         }
-        Ok(None)
     }
 
     pub fn save(&self, cb: &mut Clipboard) -> Result<()> {
@@ -352,25 +1428,66 @@ impl ClipboardData {
         }
     }
 
-    pub fn get_hash(&self) -> String {
-        use sha256::digest;
+    /// Describe the data in logs with its size and short hash, see
+    /// `short_hash`. The text content is shown only if `preview` is not zero,
+    /// truncated to at most `preview` characters.
+    pub fn log_string(&self, algo: HashAlgo, preview: usize) -> String {
+        let hash = self.short_hash(algo);
+        match self {
+            ClipboardData::Text(text) if preview > 0 => {
+                let mut end = text.len();
+                if let Some((idx, _)) = text.char_indices().nth(preview) {
+                    end = idx;
+                }
+                let ellipsis = if end < text.len() { "..." } else { "" };
+                let content = Self::escape_string(&text[..end]);
+                format!("{self}, hash {hash}, `{content}`{ellipsis}")
+            }
+            _ => format!("{self}, hash {hash}"),
+        }
+    }
 
+    /// A short hash of the content, to tell the data apart in file names and
+    /// history. Unlike `get_hash`, it never contains the text itself.
+    pub fn short_hash(&self, algo: HashAlgo) -> String {
+        let mut hash = match self {
+            ClipboardData::Text(text) => algo.digest(text.as_bytes()),
+            ClipboardData::Image(_, _, data) => algo.digest(data),
+        };
+        hash.truncate(Self::LOG_HASH_SIZE);
+        hash
+    }
+
+    pub fn get_hash(&self, algo: HashAlgo) -> String {
         match self {
             ClipboardData::Text(text) => {
-                if text.len() < Self::SHA256_TEXT_SIZE {
+                if text.len() < Self::HASH_TEXT_SIZE {
                     text.clone()
                 } else {
-                    digest(text.as_str())
+                    algo.digest(text.as_bytes())
                 }
             }
-            ClipboardData::Image(_, _, data) => digest::<&[u8]>(data),
+            ClipboardData::Image(_, _, data) => algo.digest(data),
+        }
+    }
+
+    pub fn history_entry(&self, direction: Direction, algo: HashAlgo) -> Entry {
+        match self {
+            ClipboardData::Text(text) => {
+                let mut entry = Entry::new(direction, "text", text.len(), self.short_hash(algo));
+                entry.text = Some(text.clone());
+                entry
+            }
+            ClipboardData::Image(_, _, data) => {
+                Entry::new(direction, "image", data.len(), self.short_hash(algo))
+            }
         }
     }
 
     pub fn from_frame(frame: Frame) -> ClipboardData {
         match frame {
             Frame::Text(text) => ClipboardData::Text(text),
-            Frame::Image(width, height, data) => ClipboardData::Image(width, height, data.to_vec()),
+            Frame::Image(width, height, data) => ClipboardData::Image(width, height, data.into()),
             _ => unreachable!(),
         }
     }
@@ -439,8 +1556,12 @@ impl ClipboardData {
 
 impl fmt::Display for ClipboardData {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        // The content is private, only show its size here, see `log_string`.
         match self {
-            ClipboardData::Text(text) => write!(f, "Text `{}`", Self::escape_string(text.as_str())),
+            ClipboardData::Text(text) => {
+                let size = human_bytes(text.len() as u32);
+                write!(f, "Text {size}")
+            }
             ClipboardData::Image(width, height, data) => {
                 let size = human_bytes(data.len() as u32);
                 write!(f, "Image {size}, {width}, {height}")
@@ -448,3 +1569,45 @@ impl fmt::Display for ClipboardData {
         }
     }
 }
+
+/// If `text` is a single http(s) url, return it without the tracking query
+/// parameters. Return `None` if `text` is not a url, or there is nothing to
+/// strip.
+pub fn strip_url_tracking(text: &str) -> Option<String> {
+    let text = text.trim();
+    if !(text.starts_with("http://") || text.starts_with("https://"))
+        || text.contains(char::is_whitespace)
+    {
+        return None;
+    }
+
+    let (url, fragment) = match text.split_once('#') {
+        Some((url, fragment)) => (url, Some(fragment)),
+        None => (text, None),
+    };
+    let (base, query) = url.split_once('?')?;
+
+    let params: Vec<&str> = query.split('&').collect();
+    let kept: Vec<&str> = params
+        .iter()
+        .filter(|param| {
+            let key = param.split('=').next().unwrap_or_default().to_lowercase();
+            !key.starts_with("utm_") && !URL_TRACKING_PARAMS.contains(&key.as_str())
+        })
+        .cloned()
+        .collect();
+    if kept.len() == params.len() {
+        return None;
+    }
+
+    let mut result = base.to_string();
+    if !kept.is_empty() {
+        result.push('?');
+        result.push_str(&kept.join("&"));
+    }
+    if let Some(fragment) = fragment {
+        result.push('#');
+        result.push_str(fragment);
+    }
+    Some(result)
+}
@@ -1,5 +1,6 @@
 use std::net::SocketAddr;
 
+use tokio::io::AsyncReadExt;
 use tokio::net::TcpListener;
 use tokio::sync::oneshot;
 
@@ -138,3 +139,165 @@ async fn auth_failed_image() {
 
     rx.await.unwrap();
 }
+
+#[tokio::test]
+async fn auth_size() {
+    const DATA_LEN: usize = 1 << 20;
+    let addr = "0.0.0.0:9833";
+    let auth_key = Auth::digest("Test password 123".to_string());
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (mut socket, _) = listener.accept().await.unwrap();
+        let mut buf = Vec::new();
+        socket.read_to_end(&mut buf).await.unwrap();
+        tx.send(buf).unwrap();
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9833").await.unwrap();
+    client.with_auth(Auth::new(&auth_key));
+    let text = "a".repeat(DATA_LEN);
+    client.send_text(text).await.unwrap();
+    drop(client);
+
+    // The encrypted data should only grow by the 12 bytes nonce and the 16
+    // bytes tag, it must not be encoded again before writing.
+    let cipher_len = DATA_LEN + 12 + 16;
+    let expect = 1 + cipher_len.to_string().len() + 2 + cipher_len + 2;
+    let buf = rx.await.unwrap();
+    assert_eq!(buf.len(), expect);
+    // The frame type is the same as the unencrypted one, so that the peers
+    // of older versions can read it.
+    assert_eq!(buf[0], b't');
+}
+
+#[tokio::test]
+async fn auth_mismatch() {
+    let addr = "0.0.0.0:9834";
+    let auth_key = Auth::digest("Test password 123".to_string());
+    let auth_key_client = auth_key.clone();
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        // The password is configured, but the peer has none.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("Received unencrypted data"));
+
+        // Same as above, but plain data is allowed.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        conn.with_allow_plain(true);
+        match conn.read_frame().await.unwrap().unwrap() {
+            Frame::Text(text) => assert_eq!(text, "plain text"),
+            _ => panic!("unexpected frame type"),
+        }
+
+        // An image is told by its size, it is not utf-8.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("Received unencrypted data"));
+
+        // The peer has a wrong password, its data must not be taken as plain
+        // even if plain data is allowed.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        conn.with_allow_plain(true);
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("the password may be incorrect"));
+
+        // The peer has a password, but we have none.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("Received encrypted data"));
+
+        tx.send(()).unwrap();
+    });
+
+    // The connections are accepted in order by the server.
+    for _ in 0..2 {
+        let mut client = Client::dial_string("127.0.0.1:9834").await.unwrap();
+        let _ = client.send_text("plain text".to_string()).await;
+    }
+
+    let mut client = Client::dial_string("127.0.0.1:9834").await.unwrap();
+    let data = (0..=255).cycle().take(8 * 8 * 4).collect::<Vec<u8>>();
+    let _ = client.send_image(8, 8, data.into()).await;
+
+    let mut client = Client::dial_string("127.0.0.1:9834").await.unwrap();
+    client.with_auth(Auth::new(&Auth::digest("Wrong password".to_string())));
+    let _ = client.send_text("encrypted text".to_string()).await;
+
+    let mut client = Client::dial_string("127.0.0.1:9834").await.unwrap();
+    client.with_auth(Auth::new(&auth_key_client));
+    let _ = client.send_text("encrypted text".to_string()).await;
+
+    rx.await.unwrap();
+}
+
+#[tokio::test]
+async fn auth_plain_file() {
+    let auth_key = Auth::digest("Test password 123".to_string());
+
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        // A plain binary file is not utf-8, it must still be accepted when
+        // plain data is allowed.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        conn.with_allow_plain(true);
+        match conn.read_frame().await.unwrap().unwrap() {
+            Frame::File(name, _, data) => {
+                assert_eq!(name, "plain.bin");
+                assert_eq!(data, (0..=255).collect::<Vec<u8>>());
+            }
+            _ => panic!("unexpected frame type"),
+        }
+
+        // A file encrypted with a wrong password is not taken as plain.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.with_auth(Auth::new(&auth_key));
+        conn.with_allow_plain(true);
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("the password may be incorrect"));
+
+        // The peer encrypts the file, but we have no password.
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        let err = conn.read_frame().await.unwrap_err();
+        assert!(format!("{err:#}").contains("Received encrypted data"));
+
+        tx.send(()).unwrap();
+    });
+
+    let data: Vec<u8> = (0..=255).collect();
+    let frame = Frame::File("plain.bin".to_string(), 0o644, data.into());
+
+    let mut client = Client::dial(&addr).await.unwrap();
+    let _ = client.write_frame(&frame).await;
+
+    let mut client = Client::dial(&addr).await.unwrap();
+    client.with_auth(Auth::new(&Auth::digest("Wrong password".to_string())));
+    let _ = client.write_frame(&frame).await;
+
+    let mut client = Client::dial(&addr).await.unwrap();
+    client.with_auth(Auth::new(&Auth::digest("Test password 123".to_string())));
+    let _ = client.write_frame(&frame).await;
+
+    rx.await.unwrap();
+}
@@ -0,0 +1,194 @@
+use std::fs;
+use std::path::PathBuf;
+use std::sync::Mutex;
+
+use csync::config::{self, FileConfig};
+
+/// The tests run in parallel and share the environment, the ones changing
+/// it hold this lock, and use their own variables.
+static ENV_LOCK: Mutex<()> = Mutex::new(());
+
+#[test]
+fn config_expand_env() {
+    let dir = std::env::temp_dir().join("csync-test-config-expand");
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).unwrap();
+
+    let _lock = ENV_LOCK.lock().unwrap();
+    std::env::set_var("CSYNC_TEST_EXPAND", "value");
+    let path = dir.join("config.toml");
+    fs::write(
+        &path,
+        r#"
+types = "${CSYNC_TEST_EXPAND}"
+active_hours = "${CSYNC_TEST_EXPAND}"
+active_days = "${CSYNC_TEST_EXPAND}"
+max_recv_image = "${CSYNC_TEST_EXPAND}"
+conflict = "${CSYNC_TEST_EXPAND}"
+prefer = "${CSYNC_TEST_EXPAND}"
+tee = "${CSYNC_TEST_EXPAND}"
+tee_name = "${CSYNC_TEST_EXPAND}"
+
+[templates]
+shell = "echo ${CSYNC_TEST_EXPAND}"
+"#,
+    )
+    .unwrap();
+
+    let mut cfg = FileConfig::load(&path, true).unwrap();
+    cfg.expand_env().unwrap();
+    let values = [
+        cfg.types,
+        cfg.active_hours,
+        cfg.active_days,
+        cfg.max_recv_image,
+        cfg.conflict,
+        cfg.prefer,
+        cfg.tee,
+        cfg.tee_name,
+    ];
+    for value in values {
+        assert_eq!(value.as_deref(), Some("value"));
+    }
+    // The templates are kept as written.
+    assert_eq!(cfg.templates["shell"], "echo ${CSYNC_TEST_EXPAND}");
+}
+
+/// Create a clean dir for the test, with the files in it.
+fn write_files(name: &str, files: &[(&str, &str)]) -> PathBuf {
+    let dir = std::env::temp_dir().join(name);
+    let _ = fs::remove_dir_all(&dir);
+    for (path, content) in files {
+        let path = dir.join(path);
+        fs::create_dir_all(path.parent().unwrap()).unwrap();
+        fs::write(path, content).unwrap();
+    }
+    dir
+}
+
+#[test]
+fn config_precedence() {
+    let dir = write_files(
+        "csync-test-config-precedence",
+        &[
+            (
+                "base.toml",
+                "interval = 1\nidle_interval = 1\nconn_max = 1\nconn_live = 1\n",
+            ),
+            (
+                "config.toml",
+                r#"
+include = ["base.toml"]
+idle_interval = 2
+conn_max = 2
+conn_live = 2
+
+[profiles.work]
+conn_live = 4
+"#,
+            ),
+            ("config.local.toml", "conn_max = 3\nconn_live = 3\n"),
+        ],
+    );
+
+    // include < file < local < profile
+    let mut cfg = FileConfig::load(&dir.join("config.toml"), true).unwrap();
+    assert_eq!(cfg.interval, Some(1));
+    assert_eq!(cfg.idle_interval, Some(2));
+    assert_eq!(cfg.conn_max, Some(3));
+    assert_eq!(cfg.conn_live, Some(3));
+
+    cfg.use_profile("work").unwrap();
+    assert_eq!(cfg.conn_live, Some(4));
+    assert!(cfg.use_profile("home").is_err());
+}
+
+#[test]
+fn config_include_cycle() {
+    let dir = write_files(
+        "csync-test-config-cycle",
+        &[
+            ("self.toml", r#"include = ["sub/../self.toml"]"#),
+            ("sub/keep", ""),
+            ("a.toml", r#"include = ["b.toml"]"#),
+            ("b.toml", r#"include = ["./a.toml"]"#),
+            ("ok.toml", r#"include = ["b2.toml", "b2.toml"]"#),
+            ("b2.toml", "interval = 1\n"),
+        ],
+    );
+
+    for name in ["self.toml", "a.toml"] {
+        let err = FileConfig::load(&dir.join(name), true).unwrap_err();
+        assert!(
+            format!("{err:#}").contains("includes itself"),
+            "{name}: {err:#}"
+        );
+    }
+
+    // Including the same file twice is not a cycle.
+    let cfg = FileConfig::load(&dir.join("ok.toml"), true).unwrap();
+    assert_eq!(cfg.interval, Some(1));
+}
+
+#[test]
+fn config_unknown() {
+    let dir = write_files(
+        "csync-test-config-unknown",
+        &[
+            (
+                "config.toml",
+                "interval = 1\nunknown_option = 1\n\n[profiles.work]\nunknown_profile_option = 1\n",
+            ),
+            ("config.json", r#"{"interval": 1, "unknown_option": 1}"#),
+        ],
+    );
+
+    for name in ["config.toml", "config.json"] {
+        let path = dir.join(name);
+        let err = FileConfig::load(&path, true).unwrap_err();
+        assert!(
+            format!("{err:#}").contains("unknown_option"),
+            "{name}: {err:#}"
+        );
+
+        let cfg = FileConfig::load(&path, false).unwrap();
+        assert_eq!(cfg.interval, Some(1));
+    }
+
+    let err = FileConfig::load(&dir.join("config.toml"), true).unwrap_err();
+    assert!(
+        format!("{err:#}").contains("unknown_profile_option"),
+        "{err:#}"
+    );
+}
+
+#[test]
+fn expand_env() {
+    let _lock = ENV_LOCK.lock().unwrap();
+    std::env::set_var("CSYNC_TEST_EXPAND_VAR", "value");
+    std::env::remove_var("CSYNC_TEST_EXPAND_UNSET");
+
+    let cases = [
+        ("plain", "plain"),
+        ("${CSYNC_TEST_EXPAND_VAR}", "value"),
+        ("a-${CSYNC_TEST_EXPAND_VAR}-b", "a-value-b"),
+        ("$$", "$"),
+        ("$${CSYNC_TEST_EXPAND_VAR}", "${CSYNC_TEST_EXPAND_VAR}"),
+        ("$$${CSYNC_TEST_EXPAND_VAR}", "$value"),
+        ("a$b", "a$b"),
+        ("end$", "end$"),
+    ];
+    for (s, expect) in cases {
+        assert_eq!(config::expand_env(s).unwrap(), expect, "{s}");
+    }
+
+    let errors = [
+        "${",
+        "${CSYNC_TEST_EXPAND_VAR",
+        "${}",
+        "${CSYNC_TEST_EXPAND_UNSET}",
+    ];
+    for s in errors {
+        assert!(config::expand_env(s).is_err(), "{s}");
+    }
+}
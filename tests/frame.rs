@@ -1,8 +1,10 @@
 use std::net::SocketAddr;
 
 use bytes::Bytes;
-use tokio::net::TcpListener;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+use tokio::net::{TcpListener, TcpStream};
 use tokio::sync::oneshot;
+use tokio::time::{self, Duration, Instant};
 
 use csync::net::{Client, Connection, Frame};
 
@@ -146,3 +148,219 @@ async fn frame_mix() {
 
     rx.await.unwrap();
 }
+
+#[tokio::test]
+async fn frame_size() {
+    const DATA_LEN: usize = 1 << 20;
+    let addr = "0.0.0.0:9826";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (mut socket, _) = listener.accept().await.unwrap();
+        let mut buf = Vec::new();
+        socket.read_to_end(&mut buf).await.unwrap();
+        tx.send(buf.len()).unwrap();
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9826").await.unwrap();
+    let data = Bytes::from(vec![0xffu8; DATA_LEN]);
+    client.send_image(1920, 1080, data).await.unwrap();
+    drop(client);
+
+    // The image data must be written as raw bytes, the only overhead is the
+    // frame header: "i1920\r\n1080\r\n1048576\r\n" and the tailing "\r\n".
+    let expect = DATA_LEN + 1 + 6 + 6 + 9 + 2;
+    assert_eq!(rx.await.unwrap(), expect);
+}
+
+#[tokio::test]
+async fn frame_bandwidth() {
+    const BANDWIDTH: u64 = 100 << 10;
+    const DATA_LEN: usize = 150 << 10;
+    let addr = "0.0.0.0:9827";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+
+        let frame = conn.read_frame().await.unwrap().unwrap();
+        match frame {
+            Frame::Image(_, _, data) => assert_eq!(data.len(), DATA_LEN),
+            _ => panic!("unexpected frame type"),
+        }
+        tx.send(()).unwrap();
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9827").await.unwrap();
+    client.with_bandwidth(BANDWIDTH);
+
+    let start = Instant::now();
+    let data = Bytes::from(vec![0u8; DATA_LEN]);
+    client.send_image(10, 10, data).await.unwrap();
+    rx.await.unwrap();
+
+    // 150KiB under 100KiB/s should take about 1.5s.
+    let elapsed = start.elapsed().as_millis();
+    assert!(elapsed >= 1400, "sent too fast: {elapsed}ms");
+}
+
+#[tokio::test]
+async fn frame_timeout() {
+    const BANDWIDTH: u64 = 100 << 10;
+    const DATA_LEN: usize = 150 << 10;
+    let addr = "0.0.0.0:9835";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+
+        let frame = conn.read_frame().await.unwrap().unwrap();
+        match frame {
+            Frame::Image(_, _, data) => assert_eq!(data.len(), DATA_LEN),
+            _ => panic!("unexpected frame type"),
+        }
+        tx.send(()).unwrap();
+    });
+
+    // The frame takes about 1.5s under the bandwidth, longer than the
+    // timeout, but it keeps moving, so it must not time out.
+    let mut client = Client::dial_string("127.0.0.1:9835").await.unwrap();
+    client.with_bandwidth(BANDWIDTH);
+    client.with_timeout(Some(Duration::from_millis(500)));
+
+    let data = Bytes::from(vec![0u8; DATA_LEN]);
+    client.send_image(10, 10, data).await.unwrap();
+    rx.await.unwrap();
+}
+
+#[tokio::test]
+async fn frame_timeout_stuck() {
+    const DATA_LEN: usize = 64 << 20;
+    let addr = "0.0.0.0:9836";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel::<()>();
+    tokio::spawn(async move {
+        // Accept but never read, the writes stop making progress once the
+        // socket buffers are full.
+        let (_socket, _) = listener.accept().await.unwrap();
+        let _ = rx.await;
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9836").await.unwrap();
+    client.with_timeout(Some(Duration::from_millis(500)));
+
+    let data = Bytes::from(vec![0u8; DATA_LEN]);
+    let result = time::timeout(Duration::from_secs(10), client.send_image(10, 10, data))
+        .await
+        .expect("the client timeout did not fire");
+    assert!(result.is_err());
+    tx.send(()).unwrap();
+}
+
+#[tokio::test]
+async fn frame_file_mode() {
+    let addr = "0.0.0.0:9837";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+
+        let frame = conn.read_frame().await.unwrap().unwrap();
+        match frame {
+            // The setuid bit is dropped.
+            Frame::File(name, mode, _) => {
+                assert_eq!(name, "run.sh");
+                assert_eq!(mode, 0o755);
+            }
+            _ => panic!("unexpected frame type"),
+        }
+        tx.send(()).unwrap();
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9837").await.unwrap();
+    let frame = Frame::File("run.sh".to_string(), 0o4755, Bytes::from("echo"));
+    client.write_frame(&frame).await.unwrap();
+    rx.await.unwrap();
+}
+
+#[tokio::test]
+async fn frame_limit() {
+    let addr = "0.0.0.0:9828";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        for _ in 0..4 {
+            let (socket, _) = listener.accept().await.unwrap();
+            let mut conn = Connection::new(socket);
+            conn.with_max_frame_size(1024);
+            assert!(conn.read_frame().await.is_err());
+        }
+        tx.send(()).unwrap();
+    });
+
+    let bad_frames: [&[u8]; 4] = [
+        // Data larger than the limit, must be rejected before it arrives.
+        b"t1048576\r\n",
+        // Size overflowing u64.
+        b"t99999999999999999999999\r\n",
+        // File mode out of range.
+        b"fname\r\n999999\r\n3\r\nabc\r\n",
+        // Endless line.
+        &[b'f'; 8192],
+    ];
+    for frame in bad_frames {
+        let mut socket = TcpStream::connect("127.0.0.1:9828").await.unwrap();
+        socket.write_all(frame).await.unwrap();
+        // Keep the socket open, the reader must fail without waiting for EOF.
+        let mut buf = [0; 1];
+        let _ = socket.read(&mut buf).await;
+    }
+
+    rx.await.unwrap();
+}
+
+#[tokio::test]
+async fn client_alive() {
+    let addr = "0.0.0.0:9829";
+
+    let bind: SocketAddr = addr.parse().unwrap();
+    let listener = TcpListener::bind(&bind).await.unwrap();
+    let (tx, rx) = oneshot::channel();
+    tokio::spawn(async move {
+        let (socket, _) = listener.accept().await.unwrap();
+        let mut conn = Connection::new(socket);
+        conn.read_frame().await.unwrap().unwrap();
+        rx.await.unwrap();
+        // Close the connection, like a restarted peer.
+    });
+
+    let mut client = Client::dial_string("127.0.0.1:9829").await.unwrap();
+    client.send_text("hello".to_string()).await.unwrap();
+    assert!(client.is_alive());
+
+    tx.send(()).unwrap();
+    let mut alive = true;
+    for _ in 0..50 {
+        alive = client.is_alive();
+        if !alive {
+            break;
+        }
+        time::sleep(Duration::from_millis(20)).await;
+    }
+    assert!(!alive, "closed connection is still alive");
+}
@@ -0,0 +1,46 @@
+use std::fs;
+
+use csync::history::{Direction, Entry, History};
+
+#[tokio::test]
+async fn history() {
+    let dir = std::env::temp_dir().join("csync-test-history");
+    let _ = fs::remove_dir_all(&dir);
+    fs::create_dir_all(&dir).unwrap();
+
+    let mut history = History::open(&dir, 3).unwrap();
+    for i in 0..10 {
+        let mut entry = Entry::new(Direction::Sent, "text", 1, format!("hash{i}"));
+        entry.text = Some(format!("text {i}"));
+        history.record(entry).await.unwrap();
+    }
+
+    let entries = History::load(&dir).unwrap();
+    let entries: Vec<_> = entries.iter().rev().take(3).collect();
+    let texts: Vec<_> = entries.iter().map(|e| e.text.as_deref().unwrap()).collect();
+    assert_eq!(texts, ["text 9", "text 8", "text 7"]);
+
+    // The file is rewritten once it grows to twice the capacity.
+    let lines = fs::read_to_string(dir.join("history.jsonl"))
+        .unwrap()
+        .lines()
+        .count();
+    assert!(lines <= 6, "history file is not rewritten: {lines} lines");
+
+    // The entries are kept after reopening.
+    let mut history = History::open(&dir, 3).unwrap();
+    let entry = Entry::new(Direction::Received, "image", 4, "hash10".to_string());
+    history.record(entry).await.unwrap();
+    let entries = History::load(&dir).unwrap();
+    let last = entries.last().unwrap();
+    assert_eq!(last.direction, Direction::Received);
+    assert_eq!(last.hash, "hash10");
+
+    // The text may be a password, only the owner can read the file.
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let meta = fs::metadata(dir.join("history.jsonl")).unwrap();
+        assert_eq!(meta.permissions().mode() & 0o777, 0o600);
+    }
+}
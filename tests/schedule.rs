@@ -0,0 +1,73 @@
+use chrono::Weekday;
+
+use csync::schedule::Schedule;
+
+fn minute(s: &str) -> u32 {
+    let (hour, minute) = s.split_once(':').unwrap();
+    hour.parse::<u32>().unwrap() * 60 + minute.parse::<u32>().unwrap()
+}
+
+#[test]
+fn schedule_window() {
+    let schedule = Schedule::parse("09:00-18:00", "mon-fri").unwrap();
+    let cases = [
+        (Weekday::Mon, "09:00", true),
+        (Weekday::Wed, "12:30", true),
+        (Weekday::Fri, "17:59", true),
+        (Weekday::Fri, "18:00", false),
+        (Weekday::Mon, "08:59", false),
+        (Weekday::Sat, "12:00", false),
+    ];
+    for (weekday, time, expect) in cases {
+        assert_eq!(
+            schedule.contains(weekday, minute(time)),
+            expect,
+            "{weekday} {time}"
+        );
+    }
+}
+
+#[test]
+fn schedule_cross_midnight() {
+    // The part after midnight belongs to the day before, so Fri 22:00 to
+    // Sat 02:00 is active, but Mon 00:00 to 02:00 is not.
+    let schedule = Schedule::parse("22:00-02:00", "mon-fri").unwrap();
+    let cases = [
+        (Weekday::Fri, "22:00", true),
+        (Weekday::Fri, "23:59", true),
+        (Weekday::Sat, "00:00", true),
+        (Weekday::Sat, "01:59", true),
+        (Weekday::Sat, "02:00", false),
+        (Weekday::Sat, "22:00", false),
+        (Weekday::Mon, "01:00", false),
+        (Weekday::Tue, "01:00", true),
+        (Weekday::Wed, "12:00", false),
+    ];
+    for (weekday, time, expect) in cases {
+        assert_eq!(
+            schedule.contains(weekday, minute(time)),
+            expect,
+            "{weekday} {time}"
+        );
+    }
+}
+
+#[test]
+fn schedule_parse() {
+    // Empty hours means all day on the days.
+    let schedule = Schedule::parse("", "sat,sun").unwrap();
+    assert!(schedule.contains(Weekday::Sun, minute("00:00")));
+    assert!(schedule.contains(Weekday::Sat, minute("23:59")));
+    assert!(!schedule.contains(Weekday::Mon, minute("12:00")));
+
+    let invalid = [
+        ("09:00-09:00", ""),
+        ("09:00", ""),
+        ("25:00-26:00", ""),
+        ("", "fri-mon"),
+        ("", "someday"),
+    ];
+    for (hours, days) in invalid {
+        assert!(Schedule::parse(hours, days).is_err(), "{hours} {days}");
+    }
+}
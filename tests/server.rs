@@ -7,7 +7,7 @@ use tokio::sync::{mpsc, oneshot};
 #[tokio::test]
 async fn server() {
     let addr: SocketAddr = String::from("0.0.0.0:9908").parse().unwrap();
-    let (sender, mut receiver) = mpsc::channel::<Frame>(512);
+    let (sender, mut receiver) = mpsc::channel::<(SocketAddr, Frame)>(512);
     let mut srv = Server::new(&addr, sender, 100).await.unwrap();
     tokio::spawn(async move { srv.run().await.unwrap() });
 
@@ -16,7 +16,8 @@ async fn server() {
     let (tx, rx) = oneshot::channel();
     tokio::spawn(async move {
         for i in 0..LOOP_LEN {
-            let frame = receiver.recv().await.unwrap();
+            let (from, frame) = receiver.recv().await.unwrap();
+            assert!(from.ip().is_loopback());
             match frame {
                 Frame::Text(text) => {
                     let expect = format!("{i}: Test text info\r\nThis is next line\r\ndone!\r\n");
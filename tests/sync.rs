@@ -0,0 +1,771 @@
+use std::collections::HashMap;
+use std::net::SocketAddr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+
+use anyhow::Result;
+use clap::Parser;
+use tokio::net::{TcpListener, TcpSocket, TcpStream};
+use tokio::sync::mpsc::{self, Sender};
+use tokio::time::{self, Duration, Instant};
+
+use csync::config::{Arg, Config};
+use csync::history::{Direction, History};
+use csync::net::{Connection, Frame};
+use csync::sync::{self, ClipboardData, ClipboardDriver, HashAlgo, MemoryClipboard, Synchronizer};
+
+fn config(target: &str) -> Config {
+    config_with(target, &[])
+}
+
+fn config_with(target: &str, extra: &[&str]) -> Config {
+    let dir = std::env::temp_dir().join("csync-test-sync");
+    let dir = dir.to_str().unwrap();
+    let mut args = vec![
+        "csync",
+        "--target",
+        target,
+        "--interval",
+        "50",
+        "--dir",
+        dir,
+    ];
+    args.extend_from_slice(extra);
+    Arg::try_parse_from(args).unwrap().normalize().unwrap()
+}
+
+/// The address of the peer the frames in the tests come from.
+fn peer() -> SocketAddr {
+    "127.0.0.1:9800".parse().unwrap()
+}
+
+/// Accept connections on a free port, and forward the frames received to the
+/// returned channel. Return the address to send to as well.
+async fn listen() -> (String, mpsc::Receiver<Frame>) {
+    let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap().to_string();
+    let (tx, rx) = mpsc::channel(16);
+    tokio::spawn(async move {
+        loop {
+            let (socket, _) = listener.accept().await.unwrap();
+            let tx = tx.clone();
+            tokio::spawn(async move {
+                let mut conn = Connection::new(socket);
+                while let Some(frame) = conn.read_frame().await.unwrap() {
+                    tx.send(frame).await.unwrap();
+                }
+            });
+        }
+    });
+    (addr, rx)
+}
+
+/// Receive the next text frame sent to the target.
+async fn recv_text(target: &mut mpsc::Receiver<Frame>) -> String {
+    let frame = time::timeout(Duration::from_secs(3), target.recv())
+        .await
+        .expect("nothing is sent")
+        .unwrap();
+    match frame {
+        Frame::Text(text) => text,
+        _ => panic!("unexpected frame type"),
+    }
+}
+
+/// Poll `cond` until it holds, wrap it with a timeout.
+async fn until(mut cond: impl FnMut() -> bool) {
+    while !cond() {
+        time::sleep(Duration::from_millis(10)).await;
+    }
+}
+
+/// Wait until the synchronizer has taken all the frames sent to it.
+async fn wait_taken(sender: &Sender<(SocketAddr, Frame)>) {
+    time::timeout(
+        Duration::from_secs(3),
+        until(|| sender.capacity() == sender.max_capacity()),
+    )
+    .await
+    .expect("the frames are not taken");
+}
+
+/// A memory clipboard that counts the reads, to tell when the synchronizer
+/// has seen a change. The clones share the same data and count.
+#[derive(Clone, Default)]
+struct CountClipboard {
+    inner: MemoryClipboard,
+    reads: Arc<AtomicUsize>,
+}
+
+impl CountClipboard {
+    fn new() -> CountClipboard {
+        CountClipboard::default()
+    }
+
+    fn get(&self) -> Option<ClipboardData> {
+        self.inner.get()
+    }
+
+    fn set(&self, data: ClipboardData) {
+        self.inner.set(data);
+    }
+
+    /// Wait until the clipboard is read again. The tests run on a single
+    /// thread, so the synchronizer reads nothing between a `set` and this.
+    async fn wait_read(&self) {
+        let reads = self.reads.load(Ordering::SeqCst);
+        time::timeout(
+            Duration::from_secs(3),
+            until(|| self.reads.load(Ordering::SeqCst) > reads),
+        )
+        .await
+        .expect("the clipboard is not read");
+    }
+
+    /// Wait until the clipboard holds `expect`.
+    async fn wait_for(&self, expect: &ClipboardData) {
+        time::timeout(
+            Duration::from_secs(3),
+            until(|| self.get().as_ref() == Some(expect)),
+        )
+        .await
+        .unwrap_or_else(|_| panic!("the clipboard is {:?}", self.get()));
+    }
+}
+
+impl ClipboardDriver for CountClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        let data = self.inner.read();
+        self.reads.fetch_add(1, Ordering::SeqCst);
+        data
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        self.inner.write(data)
+    }
+}
+
+#[tokio::test]
+async fn sync_send() {
+    let (addr, mut target) = listen().await;
+    let cfg = config(&addr);
+
+    let clipboard = CountClipboard::new();
+    clipboard.set(ClipboardData::Text("initial".to_string()));
+    let (mut syncer, _sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    // The initial data should not be sent, only the changes.
+    clipboard.wait_read().await;
+    clipboard.set(ClipboardData::Text("hello".to_string()));
+    assert_eq!(recv_text(&mut target).await, "hello");
+}
+
+/// Listen on a free port without accepting, once the backlog is filled, the
+/// connections to it hang until they time out, like an unreachable peer.
+async fn listen_hang() -> (String, TcpListener) {
+    let socket = TcpSocket::new_v4().unwrap();
+    socket.bind("127.0.0.1:0".parse().unwrap()).unwrap();
+    let listener = socket.listen(0).unwrap();
+    let addr = listener.local_addr().unwrap();
+    for _ in 0..4 {
+        let _ = time::timeout(Duration::from_millis(100), TcpStream::connect(addr)).await;
+    }
+    (addr.to_string(), listener)
+}
+
+#[tokio::test]
+async fn sync_send_unreachable() {
+    let (hang, _hang) = listen_hang().await;
+    let (addr, mut target) = listen().await;
+    let cfg = config(&format!("{hang},{addr}"));
+
+    let clipboard = MemoryClipboard::new();
+    let (mut syncer, _sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    // The unreachable target must hold up neither watching the clipboard,
+    // nor the other target.
+    for text in ["one", "two", "three"] {
+        clipboard.set(ClipboardData::Text(text.to_string()));
+        let frame = time::timeout(Duration::from_secs(1), target.recv())
+            .await
+            .unwrap()
+            .unwrap();
+        match frame {
+            Frame::Text(recv) => assert_eq!(recv, text),
+            _ => panic!("unexpected frame type"),
+        }
+    }
+}
+
+#[tokio::test]
+async fn sync_recv() {
+    let (addr, mut target) = listen().await;
+    let cfg = config(&addr);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    sender
+        .send((
+            peer(),
+            Frame::Image(2, 1, vec![1, 2, 3, 4, 5, 6, 7, 8].into()),
+        ))
+        .await
+        .unwrap();
+
+    let expect = ClipboardData::Image(2, 1, vec![1, 2, 3, 4, 5, 6, 7, 8]);
+    clipboard.wait_for(&expect).await;
+
+    // The data written by the synchronizer must not be sent back.
+    let result = time::timeout(Duration::from_millis(500), target.recv()).await;
+    assert!(result.is_err(), "received data is sent back");
+}
+
+#[tokio::test]
+async fn sync_aba() {
+    let (addr, mut target) = listen().await;
+    let cfg = config(&addr);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    let a = ClipboardData::Text("a".to_string());
+    let b = ClipboardData::Text("b".to_string());
+    for _ in 0..2 {
+        // A is received from the peer, B is then copied locally, the same
+        // content again in either direction must still be synced.
+        sender
+            .send((peer(), Frame::Text("a".to_string())))
+            .await
+            .unwrap();
+        clipboard.wait_for(&a).await;
+
+        // Let the synchronizer read A back before copying B.
+        clipboard.wait_read().await;
+        clipboard.set(b.clone());
+        assert_eq!(recv_text(&mut target).await, "b");
+    }
+}
+
+#[tokio::test]
+async fn sync_recv_burst() {
+    let (addr, mut target) = listen().await;
+    let cfg = config_with(&addr, &["--write-retry", "0"]);
+
+    let clipboard = MemoryClipboard::new();
+    let stale = Arc::new(Mutex::new(None));
+    let laggy = LaggyClipboard {
+        inner: clipboard.clone(),
+        stale: stale.clone(),
+    };
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(laggy))
+        .await
+        .unwrap();
+
+    // Both frames are written before the clipboard is read again, then the
+    // clipboard still returns the first one once.
+    sender
+        .send((peer(), Frame::Text("a".to_string())))
+        .await
+        .unwrap();
+    sender
+        .send((peer(), Frame::Text("b".to_string())))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    let expect = ClipboardData::Text("b".to_string());
+    let done =
+        until(|| clipboard.get().as_ref() == Some(&expect) && stale.lock().unwrap().is_none());
+    time::timeout(Duration::from_secs(3), done)
+        .await
+        .expect("the older write is not read");
+
+    let result = time::timeout(Duration::from_millis(500), target.recv()).await;
+    assert!(result.is_err(), "an older write is sent back");
+}
+
+/// A clipboard that falls behind, the first read after a write returns the
+/// data written before.
+struct LaggyClipboard {
+    inner: MemoryClipboard,
+    stale: Arc<Mutex<Option<ClipboardData>>>,
+}
+
+impl ClipboardDriver for LaggyClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        if let Some(data) = self.stale.lock().unwrap().take() {
+            return Ok(Some(data));
+        }
+        self.inner.read()
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        *self.stale.lock().unwrap() = self.inner.get();
+        self.inner.write(data)
+    }
+}
+
+/// A clipboard that silently ignores the first `drop` writes.
+struct FlakyClipboard {
+    inner: CountClipboard,
+    drop: usize,
+}
+
+impl ClipboardDriver for FlakyClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        self.inner.read()
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        if self.drop > 0 {
+            self.drop -= 1;
+            return Ok(());
+        }
+        self.inner.write(data)
+    }
+}
+
+/// A clipboard that converts the pixels of the images written, like some
+/// platforms do.
+struct ConvertClipboard {
+    inner: CountClipboard,
+}
+
+impl ClipboardDriver for ConvertClipboard {
+    fn read(&mut self) -> Result<Option<ClipboardData>> {
+        self.inner.read()
+    }
+
+    fn write(&mut self, data: &ClipboardData) -> Result<()> {
+        match data {
+            ClipboardData::Image(width, height, pixels) => {
+                let pixels = pixels.iter().map(|p| p.wrapping_add(1)).collect();
+                self.inner
+                    .write(&ClipboardData::Image(*width, *height, pixels))
+            }
+            data => self.inner.write(data),
+        }
+    }
+}
+
+#[tokio::test]
+async fn sync_write_converted() {
+    let (addr, mut target) = listen().await;
+    let cfg = config(&addr);
+
+    let clipboard = CountClipboard::new();
+    let convert = ConvertClipboard {
+        inner: clipboard.clone(),
+    };
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(convert))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    sender
+        .send((
+            peer(),
+            Frame::Image(2, 1, vec![1, 2, 3, 4, 5, 6, 7, 8].into()),
+        ))
+        .await
+        .unwrap();
+
+    // The converted image is accepted without retrying, and is not sent back.
+    let expect = ClipboardData::Image(2, 1, vec![2, 3, 4, 5, 6, 7, 8, 9]);
+    clipboard.wait_for(&expect).await;
+
+    let result = time::timeout(Duration::from_millis(500), target.recv()).await;
+    assert!(result.is_err(), "received data is sent back");
+}
+
+#[tokio::test]
+async fn sync_write_retry() {
+    let (addr, _target) = listen().await;
+    let cfg = config(&addr);
+
+    let clipboard = CountClipboard::new();
+    let flaky = FlakyClipboard {
+        inner: clipboard.clone(),
+        drop: 2,
+    };
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(flaky))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    sender
+        .send((peer(), Frame::Text("retry".to_string())))
+        .await
+        .unwrap();
+
+    let expect = ClipboardData::Text("retry".to_string());
+    clipboard.wait_for(&expect).await;
+}
+
+#[tokio::test]
+async fn sync_conflict_prefer_local() {
+    let (addr, mut target) = listen().await;
+    let cfg = config_with(&addr, &["--conflict", "prefer-local"]);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    // Wait for the local change to be sent, then receive the data from the
+    // peer, it should be dropped.
+    clipboard.set(ClipboardData::Text("local".to_string()));
+    assert_eq!(recv_text(&mut target).await, "local");
+    sender
+        .send((peer(), Frame::Text("remote".to_string())))
+        .await
+        .unwrap();
+    wait_taken(&sender).await;
+
+    let expect = ClipboardData::Text("local".to_string());
+    let changed = until(|| clipboard.get().as_ref() != Some(&expect));
+    let result = time::timeout(Duration::from_millis(300), changed).await;
+    assert!(result.is_err(), "the local change is overwritten");
+}
+
+#[tokio::test]
+async fn sync_observe() {
+    let (addr, mut target) = listen().await;
+    let cfg = config_with(&addr, &["--observe"]);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    // Neither the local change is sent, nor the data received is written.
+    clipboard.set(ClipboardData::Text("local".to_string()));
+    clipboard.wait_read().await;
+    sender
+        .send((peer(), Frame::Text("remote".to_string())))
+        .await
+        .unwrap();
+    wait_taken(&sender).await;
+
+    let result = time::timeout(Duration::from_millis(500), target.recv()).await;
+    assert!(result.is_err(), "data is sent in observe mode");
+    let expect = ClipboardData::Text("local".to_string());
+    assert_eq!(clipboard.get(), Some(expect));
+}
+
+#[tokio::test]
+async fn sync_tee() {
+    let (addr, _target) = listen().await;
+    let dir = std::env::temp_dir().join("csync-test-sync-tee");
+    let _ = std::fs::remove_dir_all(&dir);
+    let mut cfg = config_with(&addr, &["--tee", "text"]);
+    cfg.dir = dir.clone();
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    sender
+        .send((peer(), Frame::Text("tee".to_string())))
+        .await
+        .unwrap();
+
+    // The copy is written before the clipboard.
+    let expect = ClipboardData::Text("tee".to_string());
+    clipboard.wait_for(&expect).await;
+    let found = std::fs::read_dir(&dir).unwrap().find_map(|entry| {
+        let path = entry.unwrap().path();
+        let name = path.file_name().unwrap().to_str().unwrap();
+        if name.starts_with("text-") && std::fs::read_to_string(&path).unwrap() == "tee" {
+            return Some(path);
+        }
+        None
+    });
+    let path = found.expect("text is not written to dir");
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
+    }
+    let tmp = std::fs::read_dir(&dir).unwrap().any(|entry| {
+        let path = entry.unwrap().path();
+        path.to_str().unwrap().ends_with(".csync-tmp")
+    });
+    assert!(!tmp, "temporary file is left in dir");
+}
+
+#[tokio::test]
+async fn sync_history() {
+    let (addr, mut target) = listen().await;
+    let dir = std::env::temp_dir().join("csync-test-sync-history");
+    let _ = std::fs::remove_dir_all(&dir);
+    std::fs::create_dir_all(&dir).unwrap();
+    let mut cfg = config_with(&addr, &["--history", "10"]);
+    cfg.dir = dir.clone();
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    sender
+        .send((peer(), Frame::Text("remote".to_string())))
+        .await
+        .unwrap();
+    clipboard
+        .wait_for(&ClipboardData::Text("remote".to_string()))
+        .await;
+    clipboard.set(ClipboardData::Text("local".to_string()));
+    assert_eq!(recv_text(&mut target).await, "local");
+
+    let entries = History::load(&dir).unwrap();
+    assert_eq!(entries.len(), 2);
+    assert_eq!(entries[0].direction, Direction::Received);
+    assert_eq!(entries[0].from, Some(peer().to_string()));
+    assert!(entries[0].to_string().contains(&peer().to_string()));
+    assert_eq!(entries[1].direction, Direction::Sent);
+    assert_eq!(entries[1].from, None);
+}
+
+#[tokio::test]
+async fn sync_write_idle() {
+    let (addr, mut target) = listen().await;
+    let cfg = config_with(&addr, &["--write-idle", "800"]);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    clipboard.set(ClipboardData::Text("local".to_string()));
+    clipboard.wait_read().await;
+    let changed = Instant::now();
+    assert_eq!(recv_text(&mut target).await, "local");
+    sender
+        .send((peer(), Frame::Text("remote".to_string())))
+        .await
+        .unwrap();
+
+    // The data received waits for the clipboard to be idle.
+    clipboard
+        .wait_for(&ClipboardData::Text("remote".to_string()))
+        .await;
+    let idle = changed.elapsed();
+    assert!(idle >= Duration::from_millis(750), "written after {idle:?}");
+}
+
+#[tokio::test]
+async fn sync_write_idle_copy() {
+    let (addr, mut target) = listen().await;
+    let cfg = config_with(&addr, &["--write-idle", "800"]);
+
+    let clipboard = CountClipboard::new();
+    let (mut syncer, sender) = Synchronizer::with_driver(&cfg, Box::new(clipboard.clone()))
+        .await
+        .unwrap();
+    tokio::spawn(async move { syncer.run(&cfg).await });
+
+    clipboard.set(ClipboardData::Text("local".to_string()));
+    assert_eq!(recv_text(&mut target).await, "local");
+    sender
+        .send((peer(), Frame::Text("remote".to_string())))
+        .await
+        .unwrap();
+    wait_taken(&sender).await;
+
+    // Copy again while the data received waits, the copy is newer, it must
+    // be neither overwritten nor lost.
+    clipboard.set(ClipboardData::Text("copy".to_string()));
+    assert_eq!(recv_text(&mut target).await, "copy");
+
+    let expect = ClipboardData::Text("copy".to_string());
+    let changed = until(|| clipboard.get().as_ref() != Some(&expect));
+    let result = time::timeout(Duration::from_millis(1200), changed).await;
+    assert!(result.is_err(), "the copy is overwritten");
+    let result = time::timeout(Duration::from_millis(100), target.recv()).await;
+    assert!(result.is_err(), "more data is sent");
+}
+
+#[tokio::test]
+async fn send_file() {
+    let (addr, mut target) = listen().await;
+    let cfg = config(&addr);
+
+    let path = std::env::temp_dir().join("csync-test-send-file.txt");
+    std::fs::write(&path, "file content").unwrap();
+    sync::send_file(&cfg, &path).await.unwrap();
+
+    let frame = time::timeout(Duration::from_secs(3), target.recv())
+        .await
+        .unwrap()
+        .unwrap();
+    match frame {
+        Frame::File(name, _, data) => {
+            assert_eq!(name, "csync-test-send-file.txt");
+            assert_eq!(data, "file content".as_bytes());
+        }
+        _ => panic!("unexpected frame type"),
+    }
+}
+
+#[tokio::test]
+async fn send_once_checks() {
+    let (addr, mut target) = listen().await;
+
+    // The types not synced are refused.
+    let cfg = config_with(&addr, &["--types", "text"]);
+    let path = std::env::temp_dir().join("csync-test-send-once.txt");
+    std::fs::write(&path, "file content").unwrap();
+    assert!(sync::send_file(&cfg, &path).await.is_err());
+
+    // Nothing is sent in observe mode.
+    let cfg = config_with(&addr, &["--observe"]);
+    sync::send_file(&cfg, &path).await.unwrap();
+    sync::send_text(&cfg, "hello".to_string()).await.unwrap();
+
+    let result = time::timeout(Duration::from_millis(500), target.recv()).await;
+    assert!(result.is_err(), "the data is sent");
+}
+
+#[test]
+fn strip_url_tracking() {
+    let cases = [
+        (
+            "https://example.com/a?utm_source=x&id=1&fbclid=abc#top",
+            Some("https://example.com/a?id=1#top"),
+        ),
+        (
+            " https://example.com/?UTM_Medium=x&gclid=1 ",
+            Some("https://example.com/"),
+        ),
+        ("https://example.com/a?id=1", None),
+        ("https://example.com/a", None),
+        ("example.com/?utm_source=x", None),
+        ("see https://example.com/?utm_source=x", None),
+    ];
+    for (text, expect) in cases {
+        let result = sync::strip_url_tracking(text);
+        assert_eq!(result.as_deref(), expect, "{text}");
+    }
+}
+
+#[test]
+fn log_string() {
+    let algo = HashAlgo::Sha256;
+    let data = ClipboardData::Text("secret\ntext".to_string());
+    let hash = data.short_hash(algo);
+    assert_eq!(hash.len(), 16);
+    assert_eq!(data.log_string(algo, 0), format!("Text 11 B, hash {hash}"));
+    assert_eq!(
+        data.log_string(algo, 8),
+        format!("Text 11 B, hash {hash}, `secret\\nt`...")
+    );
+    assert_eq!(
+        data.log_string(algo, 100),
+        format!("Text 11 B, hash {hash}, `secret\\ntext`")
+    );
+
+    // Short text must not leak into the hash, and multibyte characters must
+    // not be cut in the middle.
+    let data = ClipboardData::Text("你好世界你好世界".to_string());
+    let hash = data.short_hash(algo);
+    let log = data.log_string(algo, 0);
+    assert_eq!(log, format!("Text 24 B, hash {hash}"));
+    assert!(!log.contains('你'), "text leaks into log: {log}");
+    assert_eq!(
+        data.log_string(algo, 3),
+        format!("Text 24 B, hash {hash}, `你好世`...")
+    );
+
+    let data = ClipboardData::Image(1, 1, vec![0; 4]);
+    let hash = data.short_hash(algo);
+    assert_eq!(
+        data.log_string(algo, 100),
+        format!("Image 4 B, 1, 1, hash {hash}")
+    );
+}
+
+#[test]
+fn recv_limit() {
+    let image = |width: u64, height: u64| {
+        let data = vec![0u8; (width * height * 4) as usize];
+        Frame::Image(width, height, data.into())
+    };
+
+    let limit = sync::RecvLimit::parse(4, "16x8").unwrap();
+    assert!(limit.check(&Frame::Text("1234".to_string())).is_ok());
+    assert!(limit.check(&Frame::Text("12345".to_string())).is_err());
+    assert!(limit.check(&image(16, 8)).is_ok());
+    assert!(limit.check(&image(17, 8)).is_err());
+    assert!(limit.check(&image(16, 9)).is_err());
+
+    let limit = sync::RecvLimit::parse(0, "").unwrap();
+    assert!(limit.check(&Frame::Text("1".repeat(1024))).is_ok());
+    assert!(limit.check(&image(1024, 1024)).is_ok());
+
+    for image in ["16", "16x", "x8", "0x8", "16x8x4", "axb"] {
+        assert!(sync::RecvLimit::parse(0, image).is_err(), "{image}");
+    }
+}
+
+#[test]
+fn name_template() {
+    let template = sync::NameTemplate::parse("{type}/{seq}-{dims}.{ext}").unwrap();
+    let vars = [
+        ("type", "image".to_string()),
+        ("seq", "3".to_string()),
+        ("ext", "rgba".to_string()),
+    ];
+    assert_eq!(template.render(&vars), "image/3-.rgba");
+
+    for s in ["", "{type", "{from}.txt", "{}"] {
+        assert!(sync::NameTemplate::parse(s).is_err(), "{s}");
+    }
+}
+
+#[test]
+fn expand_template() {
+    let vars = HashMap::from([("name".to_string(), "csync".to_string())]);
+    let mut asked = Vec::new();
+    let text = sync::expand_template(
+        "Hello {{name}}, {{ who }} and {{who}}, fn() { {{x y}} } {{",
+        &vars,
+        |name| {
+            asked.push(name.to_string());
+            Ok(String::from("you"))
+        },
+    )
+    .unwrap();
+    assert_eq!(text, "Hello csync, you and you, fn() { {{x y}} } {{");
+    assert_eq!(asked, vec!["who"]);
+
+    let vars = csync::config::parse_vars(&["a=1".to_string(), "b=x=y".to_string()]).unwrap();
+    assert_eq!(vars["a"], "1");
+    assert_eq!(vars["b"], "x=y");
+    for var in ["a", "=1"] {
+        assert!(
+            csync::config::parse_vars(&[var.to_string()]).is_err(),
+            "{var}"
+        );
+    }
+}